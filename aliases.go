@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// aliases maps every alias of every command to its command, the aliases are lower case.
+var aliases = map[string]*command{}
+
+var (
+	// guildAliases holds the aliases that guilds added with the alias command, keyed by the guild's id
+	// and then by the alias. The values are the names of the commands.
+	guildAliases   = map[string]map[string]string{}
+	guildAliasesMu sync.RWMutex
+)
+
+// registercommands fills aliases with the aliases of cmds, it returns an error if two commands share an alias.
+func registercommands(cmds []*command) error {
+	registered := map[string]*command{}
+	for _, cmd := range cmds {
+		if len(cmd.alias) == 0 {
+			return fmt.Errorf("a command has no aliases")
+		}
+
+		for _, alias := range cmd.alias {
+			alias = strings.ToLower(alias)
+			if other, ok := registered[alias]; ok && other != cmd {
+				return fmt.Errorf("%s and %s both use the alias %q", other.alias[0], cmd.alias[0], alias)
+			}
+
+			registered[alias] = cmd
+		}
+	}
+
+	aliases = registered
+	return nil
+}
+
+// findcommand returns the command that has alias, or nil if there is none. Aliases are case-insensitive.
+func findcommand(alias string) *command {
+	return aliases[strings.ToLower(alias)]
+}
+
+// findguildcommand returns the command that has alias inside of a guild. The aliases of the commands come first,
+// then the ones that the guild added with the alias command, and then the ones of the guild's config.
+func findguildcommand(guildID, alias string) *command {
+	alias = strings.ToLower(alias)
+	if cmd := findcommand(alias); cmd != nil {
+		return cmd
+	}
+
+	guildAliasesMu.RLock()
+	name, ok := guildAliases[guildID][alias]
+	guildAliasesMu.RUnlock()
+	if ok {
+		return findcommand(name)
+	}
+
+	if name, ok := getconfig().Guilds[guildID].Aliases[alias]; ok {
+		return findcommand(name)
+	}
+
+	return nil
+}
+
+// validatealiases returns an error if an alias collides with a command's alias, or points to a command that doesn't exist.
+func validatealiases(a map[string]string) error {
+	for alias, name := range a {
+		if cmd := findcommand(alias); cmd != nil {
+			return fmt.Errorf("%s: is already an alias of %s", alias, cmd.alias[0])
+		}
+
+		if findcommand(name) == nil {
+			return fmt.Errorf("%s: there is no command called %s", alias, name)
+		}
+	}
+
+	return nil
+}
+
+// suggestcommand returns the alias that is the closest to alias inside of a guild, or an empty string if none is close enough.
+func suggestcommand(guildID, alias string) string {
+	alias = strings.ToLower(alias)
+
+	// Short aliases are close to almost every other short alias
+	if len(alias) < 3 {
+		return ""
+	}
+
+	candidates := []string{}
+	for v := range aliases {
+		candidates = append(candidates, v)
+	}
+
+	guildAliasesMu.RLock()
+	for v := range guildAliases[guildID] {
+		candidates = append(candidates, v)
+	}
+	guildAliasesMu.RUnlock()
+
+	for v := range getconfig().Guilds[guildID].Aliases {
+		candidates = append(candidates, v)
+	}
+
+	// Sorted so that ties always give the same suggestion
+	sort.Strings(candidates)
+
+	// Short aliases can only be off by one letter, otherwise everything would be suggested
+	best, bestdistance := "", 2
+	if len(alias) == 3 {
+		bestdistance = 1
+	}
+
+	for _, v := range candidates {
+		d := editdistance(alias, v)
+		if d <= bestdistance && (best == "" || d < editdistance(alias, best)) {
+			best = v
+		}
+	}
+
+	return best
+}
+
+// editdistance returns how many letters have to be inserted, removed, replaced or swapped with the next one to turn a into b.
+func editdistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	d := make([][]int, len(ra)+1)
+	for i := range d {
+		d[i] = make([]int, len(rb)+1)
+		d[i][0] = i
+	}
+
+	for j := range d[0] {
+		d[0][j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+
+			d[i][j] = min3(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+
+			// Swapped letters, i.e plya instead of play
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] && d[i-2][j-2]+1 < d[i][j] {
+				d[i][j] = d[i-2][j-2] + 1
+			}
+		}
+	}
+
+	return d[len(ra)][len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+
+	if c < a {
+		a = c
+	}
+
+	return a
+}
+
+// loadguildaliases loads the aliases that guilds have added from config.AliasesPath.
+// Aliases that aren't valid anymore, because a command changed, are dropped.
+func loadguildaliases() error {
+	body, err := ioutil.ReadFile(getconfig().AliasesPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	guildAliasesMu.Lock()
+	defer guildAliasesMu.Unlock()
+
+	err = json.Unmarshal(body, &guildAliases)
+	if err != nil {
+		return err
+	}
+
+	for id, a := range guildAliases {
+		for alias, name := range a {
+			if findcommand(alias) != nil || findcommand(name) == nil {
+				logs.with("guild", id).warnf("Dropping the alias %s, it isn't valid anymore", alias)
+				delete(a, alias)
+			}
+		}
+	}
+
+	return nil
+}
+
+// saveguildaliases writes the aliases that guilds have added to config.AliasesPath.
+func saveguildaliases() error {
+	guildAliasesMu.RLock()
+	body, err := json.MarshalIndent(guildAliases, "", "  ")
+	guildAliasesMu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(getconfig().AliasesPath, body, 0644)
+}
+
+// setguildalias adds an alias to a guild, an empty name removes it. It returns false if there was nothing to remove.
+func setguildalias(guildID, alias, name string) bool {
+	guildAliasesMu.Lock()
+	defer guildAliasesMu.Unlock()
+
+	if len(name) == 0 {
+		_, ok := guildAliases[guildID][alias]
+		delete(guildAliases[guildID], alias)
+		return ok
+	}
+
+	if guildAliases[guildID] == nil {
+		guildAliases[guildID] = map[string]string{}
+	}
+
+	guildAliases[guildID][alias] = name
+	return true
+}
+
+func cmdAlias(s session, m *commandParameter) {
+	// Without an alias, the aliases of the guild are listed
+	if !m.args.has("alias") {
+		guildAliasesMu.RLock()
+		list := []string{}
+		for alias, name := range guildAliases[m.GuildID] {
+			replaces := strings.NewReplacer(
+				"{{alias}}", alias,
+				"{{command}}", name)
+			list = append(list, replaces.Replace(m.message("loop")))
+		}
+		guildAliasesMu.RUnlock()
+
+		if len(list) == 0 {
+			s.ChannelMessageSend(m.ChannelID, m.message("empty"))
+			return
+		}
+
+		sort.Strings(list)
+		s.ChannelMessageSend(m.ChannelID, m.message("start")+strings.Join(list, "\n")+m.message("end"))
+		return
+	}
+
+	if !canmanage(s, m) {
+		s.ChannelMessageSend(m.ChannelID, m.message("permission"))
+		return
+	}
+
+	alias := strings.ToLower(m.args.str("alias"))
+	send := func(key, command string) {
+		replaces := strings.NewReplacer(
+			"{{alias}}", alias,
+			"{{command}}", command)
+		s.ChannelMessageSend(m.ChannelID, replaces.Replace(m.message(key)))
+	}
+
+	if cmd := findcommand(alias); cmd != nil {
+		send("taken", cmd.alias[0])
+		return
+	}
+
+	name := ""
+	if m.args.has("command") {
+		cmd := findcommand(m.args.str("command"))
+		if cmd == nil {
+			send("nocommand", m.args.str("command"))
+			return
+		}
+
+		name = cmd.alias[0]
+	}
+
+	if !setguildalias(m.GuildID, alias, name) {
+		send("notfound", name)
+		return
+	}
+
+	err := saveguildaliases()
+	if err != nil {
+		m.log().err(err).errorf("Cannot save the aliases of the guilds")
+	}
+
+	if len(name) > 0 {
+		send("success", name)
+	} else {
+		send("removed", name)
+	}
+}
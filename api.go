@@ -0,0 +1,590 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiServer is the http server of the api, it's nil when the api is disabled
+var apiServer *http.Server
+
+// apiMaxBody is the biggest request body that the api reads, in bytes
+const apiMaxBody = 1 << 20
+
+// apiSong is a song of the queue, as the api returns it. Durations are in seconds.
+type apiSong struct {
+	Index     int     `json:"index"`
+	ID        string  `json:"id"`
+	Title     string  `json:"title"`
+	Author    string  `json:"author"`
+	URL       string  `json:"url,omitempty"`
+	Thumbnail string  `json:"thumbnail,omitempty"`
+	Duration  float64 `json:"duration"`
+	Requester string  `json:"requester"`
+}
+
+// apiState is the state of a player, as the api returns it. Durations are in seconds.
+type apiState struct {
+	Guild       string   `json:"guild"`
+	Bot         int      `json:"bot"`
+	Channel     string   `json:"channel,omitempty"`
+	Playing     bool     `json:"playing"`
+	Paused      bool     `json:"paused"`
+	Position    float64  `json:"position"`
+	Current     *apiSong `json:"current,omitempty"`
+	Loop        string   `json:"loop"`
+	Shuffle     bool     `json:"shuffle"`
+	Volume      int      `json:"volume"`
+	QueueLength int      `json:"queueLength"`
+}
+
+// apiRoute handles a request to a route of a guild, the returned value is sent as json.
+type apiRoute func(p *player, r *http.Request) (interface{}, error)
+
+// apiError is an error that is returned with a specific status code
+type apiError struct {
+	status int
+	err    error
+}
+
+func (e *apiError) Error() string {
+	return e.err.Error()
+}
+
+// badrequest returns an error that is sent with 400 Bad Request.
+func badrequest(err error) error {
+	return &apiError{http.StatusBadRequest, err}
+}
+
+// apiRoutes holds the routes of a guild, keyed by the path after /api/guilds/<id> and then by the method.
+var apiRoutes = map[string]map[string]apiRoute{
+	"": {
+		http.MethodGet: apiGetState,
+	},
+	"/queue": {
+		http.MethodGet:    apiGetQueue,
+		http.MethodPost:   apiEnqueue,
+		http.MethodDelete: apiClear,
+	},
+	"/skip": {
+		http.MethodPost: apiSkip,
+	},
+	"/pause": {
+		http.MethodPost: apiPause,
+	},
+	"/resume": {
+		http.MethodPost: apiResume,
+	},
+	"/seek": {
+		http.MethodPost: apiSeek,
+	},
+	"/volume": {
+		http.MethodPost: apiVolume,
+	},
+	"/loop": {
+		http.MethodPost: apiLoop,
+	},
+	"/shuffle": {
+		http.MethodPost: apiShuffle,
+	},
+}
+
+// apiSongRoutes holds the routes of a song, /api/guilds/<id>/queue/<index>, keyed by the method.
+var apiSongRoutes = map[string]func(p *player, index int, r *http.Request) (interface{}, error){
+	http.MethodDelete: apiRemove,
+	http.MethodPatch:  apiMove,
+}
+
+// startapi starts listening on config.API.Address, the requests are served in the background.
+func startapi() error {
+	ln, err := net.Listen("tcp", getconfig().API.Address)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/guilds", apiauth(http.HandlerFunc(apiGuilds)))
+	mux.Handle("/api/guilds/", apiauth(http.HandlerFunc(apiGuild)))
+	mux.Handle("/api/shards", apiauth(http.HandlerFunc(apiShards)))
+
+	if d := getconfig().API.Dashboard; d.Enabled {
+		adddashboard(mux)
+		warndevlogin(d)
+	}
+
+	apiServer = &http.Server{
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: time.Minute,
+	}
+
+	go func() {
+		err := apiServer.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			logs.err(err).errorf("The api stopped")
+		}
+	}()
+
+	return nil
+}
+
+// apiauth only lets requests that have config.API.Token as their bearer token through.
+// Browsers cannot set headers on websockets, so the events can send the token as the token query parameter too.
+// Requests without a token can use the session of a user that logged in to the dashboard instead,
+// the requests that change something must then send the session's csrf token as the X-CSRF-Token header.
+func apiauth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		// Query parameters end up in the logs of proxies, so the other routes only take the header
+		if len(token) == 0 && strings.HasSuffix(r.URL.Path, "/events") {
+			token = r.URL.Query().Get("token")
+		}
+
+		if len(token) == 0 {
+			if ds := dashboardsession(r); ds != nil {
+				if r.Method != http.MethodGet && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-CSRF-Token")), []byte(ds.csrf)) != 1 {
+					apiwrite(w, http.StatusForbidden, map[string]string{"error": "invalid csrf token"})
+					return
+				}
+
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiSessionKey, ds)))
+				return
+			}
+		}
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(getconfig().API.Token)) != 1 {
+			apiwrite(w, http.StatusUnauthorized, map[string]string{"error": "invalid token"})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// errNotInGuild is returned when none of the bots is in the guild of a request
+var errNotInGuild = &apiError{http.StatusNotFound, errors.New("the bot isn't in that guild")}
+
+// apibot returns the bot whose player a request controls. It's the bot of ?bot=<id>, or else the bot that
+// the users outside of the voice channels get with the commands.
+func apibot(guildID string, r *http.Request) (*bot, error) {
+	str := r.URL.Query().Get("bot")
+	if len(str) == 0 {
+		b := pickbot(guildID, "")
+		if b == nil {
+			return nil, errNotInGuild
+		}
+
+		return b, nil
+	}
+
+	id, err := strconv.Atoi(str)
+	if err != nil || id < 0 || id >= len(bots) {
+		return nil, &apiError{http.StatusNotFound, fmt.Errorf("there is no bot %q", str)}
+	}
+
+	if !bots[id].inguild(guildID) {
+		return nil, errNotInGuild
+	}
+
+	return bots[id], nil
+}
+
+// apiGuild routes the requests of /api/guilds/<id>/... to the player of the guild.
+func apiGuild(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/guilds/"), "/")
+	guildID, route := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		guildID, route = path[:i], path[i:]
+	}
+
+	// Only the guilds that the bot is in have players, and the users of the dashboard only see the ones they are in
+	if ds := requestsession(r); ds != nil && !ds.canaccess(guildID) {
+		apiwrite(w, http.StatusNotFound, map[string]string{"error": "the bot isn't in that guild"})
+		return
+	}
+
+	b, err := apibot(guildID, r)
+	if err != nil {
+		apifail(w, err)
+		return
+	}
+
+	p, err := b.getplayer(guildID)
+	if err != nil {
+		logs.with("guild", guildID).err(err).errorf("Cannot create the player")
+		apiwrite(w, http.StatusInternalServerError, map[string]string{"error": "cannot create the player"})
+		return
+	}
+
+	// The events are streamed over a websocket instead of being returned as json
+	if route == "/events" {
+		if r.Method != http.MethodGet {
+			apiwrite(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		apiEvents(w, r, p)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, apiMaxBody)
+
+	var res interface{}
+	if strings.HasPrefix(route, "/queue/") {
+		index, err := strconv.Atoi(strings.TrimPrefix(route, "/queue/"))
+		handler, ok := apiSongRoutes[r.Method]
+		if err != nil {
+			apiwrite(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		} else if !ok {
+			apiwrite(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		res, err = handler(p, index, r)
+		if err != nil {
+			apifail(w, err)
+			return
+		}
+	} else {
+		methods, ok := apiRoutes[route]
+		if !ok {
+			apiwrite(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+
+		handler, ok := methods[r.Method]
+		if !ok {
+			apiwrite(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		res, err = handler(p, r)
+		if err != nil {
+			apifail(w, err)
+			return
+		}
+	}
+
+	apiwrite(w, http.StatusOK, res)
+}
+
+// apiwrite sends v as json.
+func apiwrite(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		logs.err(err).warnf("Cannot write the api's response")
+	}
+}
+
+// apifail sends err, errors of the player are sent as 400 Bad Request and anything else as 500 Internal Server Error.
+func apifail(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+
+	var aerr *apiError
+	if errors.As(err, &aerr) {
+		status = aerr.status
+	} else if err == errNothingPlaying || err == errNoSong || err == errSeekEnd || err == errNoVideos {
+		status = http.StatusBadRequest
+	}
+
+	apiwrite(w, status, map[string]string{"error": err.Error()})
+}
+
+// apibody decodes the json body of a request into v.
+func apibody(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		return badrequest(fmt.Errorf("invalid body: %w", err))
+	}
+
+	return nil
+}
+
+// apiarg parses value like the argument called name of a command, so that the api accepts the same values as the commands.
+func apiarg(alias, name, value string) (interface{}, error) {
+	cmd := findcommand(alias)
+	for k := range cmd.args {
+		if cmd.args[k].name == name {
+			v, err := cmd.args[k].parse(value)
+			if err != nil {
+				return nil, badrequest(fmt.Errorf("%s %w", name, err))
+			}
+
+			return v, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s has no argument called %s", alias, name)
+}
+
+// newapisong returns the song at index of the queue.
+func newapisong(vid *videoInfo, index int) *apiSong {
+	song := &apiSong{
+		Index:     index,
+		ID:        vid.Base.ID,
+		Title:     vid.Base.Title,
+		Author:    vid.Base.Author,
+		URL:       videourl(vid),
+		Duration:  vid.Base.Duration.Seconds(),
+		Requester: vid.Name,
+	}
+
+	if thumb := thumbnail(vid); thumb != nil {
+		song.Thumbnail = thumb.URL
+	}
+
+	return song
+}
+
+// newapistate returns the state of a player.
+func newapistate(p *player) *apiState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state := &apiState{
+		Guild:       p.guildID,
+		Bot:         p.bot.id,
+		Playing:     p.playingAudio,
+		Paused:      p.pause,
+		Position:    p.position.Seconds(),
+		Loop:        loopname(p.loop),
+		Shuffle:     p.shuffle,
+		Volume:      int(p.volume * 100),
+		QueueLength: len(p.queue),
+	}
+
+	if p.vc != nil {
+		state.Channel = p.channelID
+	}
+
+	queue, qi := p.queue, p.queueindex
+	if qi >= 0 && qi < len(queue) {
+		state.Current = newapisong(queue[qi], qi)
+	}
+
+	return state
+}
+
+func apiGetState(p *player, r *http.Request) (interface{}, error) {
+	return newapistate(p), nil
+}
+
+// newapiqueue returns the songs of the queue, p.mu must be held.
+func newapiqueue(p *player) []*apiSong {
+	queue := p.queue
+
+	songs := make([]*apiSong, len(queue))
+	for k, v := range queue {
+		songs[k] = newapisong(v, k)
+	}
+
+	return songs
+}
+
+func apiGetQueue(p *player, r *http.Request) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return newapiqueue(p), nil
+}
+
+func apiEnqueue(p *player, r *http.Request) (interface{}, error) {
+	var body struct {
+		// Query is a youtube url, or what to search for
+		Query string `json:"query"`
+		// User is the id of the user that requested the song, the bot joins their voice channel if it isn't in one
+		User string `json:"user"`
+	}
+
+	err := apibody(r, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(strings.TrimSpace(body.Query)) == 0 {
+		return nil, badrequest(errors.New("query is missing"))
+	}
+
+	base, err := findvideo(body.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	vid := &videoInfo{
+		Base: base,
+		Name: "API",
+	}
+
+	// The users of the dashboard request the songs themselves
+	if ds := requestsession(r); ds != nil {
+		vid.Name = "@" + ds.user.String()
+		vid.Requester = ds.user
+	} else if len(body.User) > 0 {
+		member, err := p.bot.guildsession(p.guildID).State.Member(p.guildID, body.User)
+		if err != nil {
+			return nil, badrequest(errors.New("the user isn't in the guild"))
+		}
+
+		vid.Name = "@" + member.User.String()
+		vid.Requester = member.User
+	}
+
+	index := p.enqueue(vid)
+
+	if !p.connected() && vid.Requester != nil {
+		s := discordSession{p.bot.guildsession(p.guildID)}
+		if channelID := uservoicechannel(s, p.guildID, vid.Requester.ID); len(channelID) > 0 {
+			err = p.join(s, channelID)
+			if err != nil {
+				p.log().err(err).warnf("Cannot join %s", channelID)
+			}
+		}
+	}
+
+	return newapisong(vid, index), nil
+}
+
+func apiClear(p *player, r *http.Request) (interface{}, error) {
+	p.clearqueue()
+	return newapistate(p), nil
+}
+
+func apiRemove(p *player, index int, r *http.Request) (interface{}, error) {
+	_, err := p.removesong(index)
+	if err != nil {
+		return nil, err
+	}
+
+	return newapistate(p), nil
+}
+
+func apiMove(p *player, index int, r *http.Request) (interface{}, error) {
+	var body struct {
+		// Index is where the song is moved to
+		Index *int `json:"index"`
+	}
+
+	err := apibody(r, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	if body.Index == nil {
+		return nil, badrequest(errors.New("index is missing"))
+	}
+
+	err = p.movesong(index, *body.Index)
+	if err != nil {
+		return nil, err
+	}
+
+	return newapistate(p), nil
+}
+
+func apiSkip(p *player, r *http.Request) (interface{}, error) {
+	p.skip()
+	return newapistate(p), nil
+}
+
+func apiPause(p *player, r *http.Request) (interface{}, error) {
+	p.setpause(true)
+	return newapistate(p), nil
+}
+
+func apiResume(p *player, r *http.Request) (interface{}, error) {
+	p.setpause(false)
+	return newapistate(p), nil
+}
+
+func apiSeek(p *player, r *http.Request) (interface{}, error) {
+	var body struct {
+		// Position is a duration like 90, 1:30 or 1m30s
+		Position string `json:"position"`
+	}
+
+	err := apibody(r, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := apiarg("seek", "position", body.Position)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.seek(v.(time.Duration))
+	if err != nil {
+		return nil, err
+	}
+
+	return newapistate(p), nil
+}
+
+func apiVolume(p *player, r *http.Request) (interface{}, error) {
+	var body struct {
+		Volume json.Number `json:"volume"`
+	}
+
+	err := apibody(r, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := apiarg("volume", "volume", body.Volume.String())
+	if err != nil {
+		return nil, err
+	}
+
+	p.setvolume(v.(int))
+	return newapistate(p), nil
+}
+
+func apiLoop(p *player, r *http.Request) (interface{}, error) {
+	var body struct {
+		// Mode is one of off, song or queue
+		Mode string `json:"mode"`
+	}
+
+	err := apibody(r, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := apiarg("loop", "mode", body.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	p.setloop(loopModes[v.(string)])
+	return newapistate(p), nil
+}
+
+func apiShuffle(p *player, r *http.Request) (interface{}, error) {
+	var body struct {
+		Shuffle *bool `json:"shuffle"`
+	}
+
+	err := apibody(r, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	if body.Shuffle == nil {
+		return nil, badrequest(errors.New("shuffle is missing"))
+	}
+
+	p.setshuffle(*body.Shuffle)
+	return newapistate(p), nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	ytdl "github.com/kkdai/youtube/v2"
+)
+
+func TestAPIQueueWhilePlaying(t *testing.T) {
+	_, p := newtestbot(t)
+	f := newfakesession(t)
+
+	writedca(t, "long", "Long", 3000)
+	for _, title := range []string{"One", "Two", "Three"} {
+		p.enqueue(&videoInfo{
+			Base: &ytdl.Video{ID: "long", Title: title},
+			Name: "API",
+			File: filepath.Join(getconfig().DcaPath, "long"+dcaExtension),
+		})
+	}
+
+	err := p.join(f, testVoice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitfor(t, "the song to start", func() bool {
+		_, frames, _ := f.voice.status()
+		return frames > 0
+	})
+
+	req := httptest.NewRequest("DELETE", "/api/guilds/"+testGuild+"/queue/0", nil)
+	state, err := apiRemove(p, 0, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The song that is playing stops, and the next one plays
+	if s := state.(*apiState); s.QueueLength != 2 {
+		t.Errorf("queue has %d songs, want 2", s.QueueLength)
+	}
+
+	req = httptest.NewRequest("PATCH", "/api/guilds/"+testGuild+"/queue/1", strings.NewReader(`{"index":0}`))
+	_, err = apiMove(p, 1, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = apiClear(p, httptest.NewRequest("DELETE", "/api/guilds/"+testGuild+"/queue", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitfor(t, "the song to stop", func() bool {
+		s := newapistate(p)
+		return !s.Playing && s.QueueLength == 0
+	})
+}
+
+func TestAPIAuth(t *testing.T) {
+	newtestbot(t)
+	editconfig(func(c *Config) { c.API.Token = "secret" })
+
+	handler := apiauth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name   string
+		path   string
+		header string
+		want   int
+	}{
+		{"bearer token", "/api/guilds/" + testGuild, "Bearer secret", http.StatusNoContent},
+		{"wrong token", "/api/guilds/" + testGuild, "Bearer wrong", http.StatusUnauthorized},
+		{"query token on the events", "/api/guilds/" + testGuild + "/events?token=secret", "", http.StatusNoContent},
+		{"query token elsewhere", "/api/guilds/" + testGuild + "?token=secret", "", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		if len(tt.header) > 0 {
+			req.Header.Set("Authorization", tt.header)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestDashboardDevUser(t *testing.T) {
+	newtestbot(t)
+	editconfig(func(c *Config) { c.API.Dashboard = DashboardConfig{Enabled: true, DevLogin: true, DevUser: testUser} })
+
+	for addr, want := range map[string]bool{"127.0.0.1:1234": true, "[::1]:1234": true, "192.0.2.1:1234": false, "": false} {
+		req := httptest.NewRequest("GET", "/auth/login", nil)
+		req.RemoteAddr = addr
+		if isloopback(req) != want {
+			t.Errorf("isloopback(%q) = %v, want %v", addr, !want, want)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/auth/login", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+
+	w := httptest.NewRecorder()
+	dashboardLogin(w, req)
+	if w.Code != http.StatusForbidden || len(w.Result().Cookies()) > 0 {
+		t.Errorf("the dev user logged in from another computer")
+	}
+
+	// Without the dev login, the users of this computer log in with discord too
+	editconfig(func(c *Config) { c.API.Dashboard.DevLogin = false })
+	req = httptest.NewRequest("GET", "/auth/login", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+
+	w = httptest.NewRecorder()
+	dashboardLogin(w, req)
+	if location := w.Header().Get("Location"); !strings.HasPrefix(location, discordgo.EndpointOAuth2) {
+		t.Errorf("redirected to %q, want discord", location)
+	}
+}
+
+func TestUserGuilds(t *testing.T) {
+	// The user is in 450 guilds, with the ids 1 to 450
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		after, _ := strconv.Atoi(r.URL.Query().Get("after"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+
+		page := []*discordgo.UserGuild{}
+		for id := after + 1; id <= 450 && len(page) < limit; id++ {
+			page = append(page, &discordgo.UserGuild{ID: strconv.Itoa(id)})
+		}
+
+		json.NewEncoder(w).Encode(page)
+	}))
+	defer srv.Close()
+
+	endpoint := discordgo.EndpointUsers
+	discordgo.EndpointUsers = srv.URL + "/users/"
+	defer func() { discordgo.EndpointUsers = endpoint }()
+
+	us, err := discordgo.New("Bearer token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	guilds, err := userguilds(context.Background(), us)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(guilds) != 450 || !guilds["1"] || !guilds["450"] {
+		t.Errorf("got %d guilds, want 450", len(guilds))
+	}
+}
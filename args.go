@@ -0,0 +1,332 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// argType is the type of a command's argument, it decides how the argument is parsed.
+type argType int
+
+const (
+	argString   argType = iota // A single word, or words inside of double quotes
+	argRest                    // Everything that is left of the message
+	argInt                     // A number within min and max
+	argDuration                // A duration like 90, 1:30 or 1m30s
+	argChannel                 // A mention or the id of a channel
+	argURL                     // An http or https url
+)
+
+// argSpec describes an argument that a command takes.
+type argSpec struct {
+	name     string
+	kind     argType
+	optional bool
+	// min and max are the range of argInt
+	min, max int
+	// choices are the values that argString allows, if there are any
+	choices []string
+}
+
+// arguments holds the parsed arguments of a command, keyed by their name.
+// argInt is stored as an int, argDuration as a time.Duration, and every other type as a string.
+type arguments map[string]interface{}
+
+// has returns true if the argument was given.
+func (a arguments) has(name string) bool {
+	_, ok := a[name]
+	return ok
+}
+
+// str returns an argString, argRest, argChannel or argURL, it's empty if the argument wasn't given.
+func (a arguments) str(name string) string {
+	v, _ := a[name].(string)
+	return v
+}
+
+// integer returns an argInt, and false if the argument wasn't given.
+func (a arguments) integer(name string) (int, bool) {
+	v, ok := a[name].(int)
+	return v, ok
+}
+
+// duration returns an argDuration, and false if the argument wasn't given.
+func (a arguments) duration(name string) (time.Duration, bool) {
+	v, ok := a[name].(time.Duration)
+	return v, ok
+}
+
+// argError is returned when the arguments of a command cannot be parsed.
+type argError struct {
+	// arg is the argument that isn't valid, it's nil if there are too many arguments
+	arg     *argSpec
+	missing bool
+	reason  string
+}
+
+func (e *argError) Error() string {
+	if e.arg == nil {
+		return e.reason
+	}
+
+	return e.arg.name + " " + e.reason
+}
+
+var errUnclosedQuote = errors.New("has an unclosed quote")
+
+// argScanner reads the words of a message one by one, so that argRest can take the rest of the message as it is.
+type argScanner struct {
+	str string
+	pos int
+}
+
+// skipspace moves the scanner to the start of the next word.
+func (sc *argScanner) skipspace() {
+	for sc.pos < len(sc.str) {
+		r, size := utf8.DecodeRuneInString(sc.str[sc.pos:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+
+		sc.pos += size
+	}
+}
+
+// done returns true if the message has no words left.
+func (sc *argScanner) done() bool {
+	sc.skipspace()
+	return sc.pos >= len(sc.str)
+}
+
+// next returns the next word, words inside of double quotes are returned as one word without the quotes.
+func (sc *argScanner) next() (string, error) {
+	sc.skipspace()
+
+	var b strings.Builder
+	quoted := false
+	for sc.pos < len(sc.str) {
+		r, size := utf8.DecodeRuneInString(sc.str[sc.pos:])
+		if !quoted && unicode.IsSpace(r) {
+			break
+		}
+
+		sc.pos += size
+		if r == '"' {
+			quoted = !quoted
+			continue
+		}
+
+		b.WriteRune(r)
+	}
+
+	if quoted {
+		return "", errUnclosedQuote
+	}
+
+	return b.String(), nil
+}
+
+// rest returns everything that is left of the message, a rest that is only quoted has its quotes removed.
+func (sc *argScanner) rest() string {
+	sc.skipspace()
+
+	str := strings.TrimSpace(sc.str[sc.pos:])
+	sc.pos = len(sc.str)
+
+	if len(str) >= 2 && str[0] == '"' && str[len(str)-1] == '"' && !strings.Contains(str[1:len(str)-1], `"`) {
+		str = str[1 : len(str)-1]
+	}
+
+	return str
+}
+
+// parseargs parses the arguments of a command from what's after the command's name.
+func parseargs(specs []argSpec, str string) (arguments, error) {
+	a := arguments{}
+	sc := &argScanner{str: str}
+
+	for i := range specs {
+		spec := &specs[i]
+		if sc.done() {
+			if !spec.optional {
+				return nil, &argError{arg: spec, missing: true, reason: "is missing"}
+			}
+
+			continue
+		}
+
+		var value string
+		if spec.kind == argRest {
+			value = sc.rest()
+		} else {
+			var err error
+			value, err = sc.next()
+			if err != nil {
+				return nil, &argError{arg: spec, reason: err.Error()}
+			}
+		}
+
+		v, err := spec.parse(value)
+		if err != nil {
+			return nil, &argError{arg: spec, reason: err.Error()}
+		}
+
+		a[spec.name] = v
+	}
+
+	if !sc.done() {
+		return nil, &argError{reason: "too many arguments"}
+	}
+
+	return a, nil
+}
+
+// channelRegexp matches the mention or the id of a channel
+var channelRegexp = regexp.MustCompile(`^(?:<#(\d+)>|(\d+))$`)
+
+// parse converts a single value into the type of the argument.
+func (spec *argSpec) parse(value string) (interface{}, error) {
+	switch spec.kind {
+	case argString, argRest:
+		if len(spec.choices) == 0 {
+			return value, nil
+		}
+
+		for _, v := range spec.choices {
+			if strings.EqualFold(v, value) {
+				return v, nil
+			}
+		}
+
+		return nil, fmt.Errorf("must be one of %s", strings.Join(spec.choices, ", "))
+	case argInt:
+		v, err := strconv.Atoi(value)
+		if err != nil || v < spec.min || v > spec.max {
+			return nil, fmt.Errorf("must be a number from %d to %d", spec.min, spec.max)
+		}
+
+		return v, nil
+	case argDuration:
+		v, err := parseduration(value)
+		if err != nil {
+			return nil, errors.New("must be a duration like 90, 1:30 or 1m30s")
+		}
+
+		return v, nil
+	case argChannel:
+		match := channelRegexp.FindStringSubmatch(value)
+		if match == nil {
+			return nil, errors.New("must be a mention or the id of a channel")
+		}
+
+		return match[1] + match[2], nil
+	case argURL:
+		uri, err := url.ParseRequestURI(value)
+		if err != nil || (uri.Scheme != "http" && uri.Scheme != "https") || len(uri.Host) == 0 {
+			return nil, errors.New("must be an http or https url")
+		}
+
+		return uri.String(), nil
+	}
+
+	return nil, fmt.Errorf("has an unknown type %d", spec.kind)
+}
+
+// parseduration parses durations like 90 (seconds), 1:30 (minutes and seconds), 1:02:30 (with hours) or 1m30s.
+func parseduration(str string) (time.Duration, error) {
+	d, err := time.ParseDuration(str)
+	if err == nil {
+		if d < 0 {
+			return 0, errors.New("negative duration")
+		}
+
+		return d, nil
+	}
+
+	parts := strings.Split(str, ":")
+	if len(parts) > 3 {
+		return 0, errors.New("too many parts")
+	}
+
+	for k, v := range parts {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("%q is not a number", v)
+		}
+
+		// Only the first part can go above 59, i.e 90 or 90:00 but not 1:90
+		if k > 0 && n > 59 {
+			return 0, fmt.Errorf("%q is above 59", v)
+		}
+
+		d = d*60 + time.Duration(n)*time.Second
+	}
+
+	return d, nil
+}
+
+// usage returns how a command is used, i.e "!volume [volume]" or "!play <query...>".
+func usage(cmd *command) string {
+	str := getconfig().Prefix + cmd.alias[0]
+	for _, spec := range cmd.args {
+		name := spec.name
+		if spec.kind == argRest {
+			name += "..."
+		}
+
+		if spec.optional {
+			str += " [" + name + "]"
+		} else {
+			str += " <" + name + ">"
+		}
+	}
+
+	return str
+}
+
+// usagemessage returns the message that is sent when the arguments of a command cannot be parsed.
+// Commands that have a param message use it when an argument is missing.
+func usagemessage(m *commandParameter, err error) string {
+	var aerr *argError
+	if errors.As(err, &aerr) && aerr.missing {
+		if _, ok := m.cmd.messages["param"]; ok {
+			return m.message("param")
+		}
+	}
+
+	replaces := strings.NewReplacer(
+		"{{usage}}", usage(m.cmd),
+		"{{error}}", err.Error())
+
+	return replaces.Replace(m.message("usage"))
+}
+
+// defaultUsage is the usage message of the commands that don't have their own
+const defaultUsage = "Usage: `{{usage}}`, {{error}}"
+
+// addusage gives every command a usage message, the parser sends it when the arguments cannot be parsed.
+func addusage(cmds []*command) {
+	for _, cmd := range cmds {
+		if _, ok := cmd.messages["usage"]; ok {
+			continue
+		}
+
+		if cmd.messages == nil {
+			cmd.messages = map[string]string{}
+		}
+
+		if cmd.placeholders == nil {
+			cmd.placeholders = map[string][]string{}
+		}
+
+		cmd.messages["usage"] = defaultUsage
+		cmd.placeholders["usage"] = []string{"usage", "error"}
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// bot is one of the bot identities that run in the process, every token of the config is a bot.
+// Bots have their own sessions and players, so that a guild can have music in several voice channels at once.
+type bot struct {
+	// id is the index of the bot's token in config.tokens()
+	id int
+	// shards holds a session per shard of the gateway, keyed by the shard's id
+	shards []*discordgo.Session
+	// concurrency is how many shards discord lets identify at once
+	concurrency int
+
+	// players holds the player of every guild, keyed by the guild's id
+	players   map[string]*player
+	playersMu sync.Mutex
+}
+
+var (
+	// bots holds every bot, keyed by its id
+	bots []*bot
+	// sesh is the session of the first shard of the first bot, it's used for everything that doesn't belong to a guild
+	sesh *discordgo.Session
+)
+
+// openbots creates and opens the sessions of every token, one after the other.
+func openbots(tokens []string, shards int) error {
+	for id, token := range tokens {
+		b, err := newbot(id, token, shards)
+		if err != nil {
+			return fmt.Errorf("bot %d: %w", id, err)
+		}
+
+		bots = append(bots, b)
+		if id == 0 {
+			sesh = b.shards[0]
+		}
+
+		err = b.open()
+		if err != nil {
+			return fmt.Errorf("bot %d: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+// newbot creates the sessions of a bot without opening them. If count is 0, discord recommends how many shards the bot needs.
+func newbot(id int, token string, count int) (*bot, error) {
+	b := &bot{id: id, concurrency: 1, players: map[string]*player{}}
+
+	first, err := discordgo.New("Bot " + token)
+	if err != nil {
+		return nil, err
+	}
+
+	// A single shard doesn't need to ask the gateway
+	if count != 1 {
+		gw, err := first.GatewayBot()
+		if err != nil {
+			return nil, fmt.Errorf("GatewayBot: %w", err)
+		}
+
+		if count == 0 {
+			count = gw.Shards
+			logs.with("bot", id).with("shards", count).infof("Using the shards that discord recommends")
+		}
+
+		if gw.SessionStartLimit.MaxConcurrency > 0 {
+			b.concurrency = gw.SessionStartLimit.MaxConcurrency
+		}
+	}
+
+	if count < 1 {
+		count = 1
+	}
+
+	b.shards = make([]*discordgo.Session, count)
+	for shard := range b.shards {
+		s := first
+		if shard > 0 {
+			s, err = discordgo.New("Bot " + token)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		s.ShardID = shard
+		s.ShardCount = count
+		addhandlers(s)
+
+		b.shards[shard] = s
+	}
+
+	return b, nil
+}
+
+// addhandlers adds the handlers of the bot to the session of a shard.
+func addhandlers(s *discordgo.Session) {
+	// Add a message handler to sort commands from regular messages
+	s.AddHandler(messageHandler)
+	// Players match the bitrate of their voice channel whenever it changes
+	s.AddHandler(channelUpdateHandler)
+	// Players leave when they are idle or alone
+	s.AddHandler(voiceStateUpdateHandler)
+	// Players recover the voice connections that died while the gateway was reconnecting
+	s.AddHandler(resumedHandler)
+	// The shards log when they connect and disconnect
+	s.AddHandler(readyHandler)
+	s.AddHandler(disconnectHandler)
+}
+
+// botof returns the bot that a session belongs to, or nil if it's none of them.
+func botof(s *discordgo.Session) *bot {
+	for _, b := range bots {
+		for _, shard := range b.shards {
+			if shard == s {
+				return b
+			}
+		}
+	}
+
+	return nil
+}
+
+// findplayer returns the player of a guild, or nil if the guild never used the bot.
+func (b *bot) findplayer(guildID string) *player {
+	b.playersMu.Lock()
+	defer b.playersMu.Unlock()
+
+	return b.players[guildID]
+}
+
+// allplayers returns the players of every bot.
+func allplayers() []*player {
+	var list []*player
+	for _, b := range bots {
+		b.playersMu.Lock()
+		for _, p := range b.players {
+			list = append(list, p)
+		}
+		b.playersMu.Unlock()
+	}
+
+	return list
+}
+
+// inguild returns true if the bot is in a guild.
+func (b *bot) inguild(guildID string) bool {
+	_, err := b.guildsession(guildID).State.Guild(guildID)
+	return err == nil
+}
+
+// pickbot returns the bot that handles a user of a guild. It's the bot in the user's voice channel, or else the first bot that
+// isn't in a voice channel of the guild, so that every voice channel can have its own bot. Users outside of the voice channels
+// get the first bot that is playing, the commands like queue and skip are meant for it. If neither fits, it's the first bot
+// in the guild, and nil if no bot is in the guild.
+func pickbot(guildID, userID string) *bot {
+	var first, free, busy *bot
+	var channelID string
+	for _, b := range bots {
+		if !b.inguild(guildID) {
+			continue
+		}
+
+		if first == nil {
+			first = b
+			if len(userID) > 0 {
+				channelID = uservoicechannel(discordSession{b.guildsession(guildID)}, guildID, userID)
+			}
+		}
+
+		p := b.findplayer(guildID)
+		if p == nil || !p.connected() {
+			if free == nil {
+				free = b
+			}
+			continue
+		}
+
+		p.mu.Lock()
+		inside := p.channelID == channelID
+		p.mu.Unlock()
+
+		if len(channelID) > 0 && inside {
+			return b
+		}
+
+		if busy == nil {
+			busy = b
+		}
+	}
+
+	if len(channelID) > 0 && free != nil {
+		return free
+	} else if len(channelID) == 0 && busy != nil {
+		return busy
+	}
+
+	return first
+}
+
+// dispatchTimeout is how long the bot that handles a message is remembered, every bot gets the message well within it
+const dispatchTimeout = time.Minute
+
+// dispatch is the bot that handles a message
+type dispatch struct {
+	bot     *bot
+	expires time.Time
+}
+
+var (
+	// dispatched holds the bots that handle the messages, keyed by the message's id
+	dispatched   = map[string]dispatch{}
+	dispatchedMu sync.Mutex
+)
+
+// handles returns true if b handles a message. Every bot in the guild gets the message, the first one to get it
+// picks the bot for all of them, so that exactly one of them answers.
+func (b *bot) handles(m *discordgo.MessageCreate) bool {
+	if len(bots) == 1 {
+		return true
+	}
+
+	dispatchedMu.Lock()
+	defer dispatchedMu.Unlock()
+
+	d, ok := dispatched[m.ID]
+	if !ok {
+		now := time.Now()
+		for id, d := range dispatched {
+			if now.After(d.expires) {
+				delete(dispatched, id)
+			}
+		}
+
+		d = dispatch{bot: pickbot(m.GuildID, m.Author.ID), expires: now.Add(dispatchTimeout)}
+		dispatched[m.ID] = d
+	}
+
+	return d.bot == b
+}
@@ -1,10 +1,326 @@
 package main
 
+import (
+	"fmt"
+	"sync/atomic"
+
+	"gopkg.in/hraban/opus.v2"
+)
+
 type Config struct {
-	BotToken   string `envconfig:"BOT_TOKEN"`
-	YoutubeKey string `envconfig:"YOUTUBE_KEY"`
-	Prefix     string `envconfig:"PREFIX"`
-	Status     string `envconfig:"STATUS"`
+	BotToken string `envconfig:"BOT_TOKEN"`
+	// BotTokens are the tokens of more bots that run next to BotToken, so that several voice channels of a guild can have music
+	BotTokens  []string `envconfig:"BOT_TOKENS"`
+	YoutubeKey string   `envconfig:"YOUTUBE_KEY"`
+	Prefix     string   `envconfig:"PREFIX"`
+	Status     string   `envconfig:"STATUS"`
+	// DcaPath is the directory that holds pre-encoded DCA files
+	DcaPath string `envconfig:"DCA_PATH"`
+	// DcaRecord saves every fully played song as a DCA file in DcaPath
+	DcaRecord bool `envconfig:"DCA_RECORD"`
+	// PrefetchSeconds is how many seconds before the current song ends the next song starts loading, 0 disables it
+	PrefetchSeconds int `envconfig:"PREFETCH_SECONDS"`
+	// OpusPassthrough sends the opus frames of youtube's webm streams without transcoding them
+	OpusPassthrough bool `envconfig:"OPUS_PASSTHROUGH"`
+	// IdleTimeout is how many seconds the bot stays in the voice channel after the queue ended, 0 disables it
+	IdleTimeout int `envconfig:"IDLE_TIMEOUT"`
+	// AloneTimeout is how many seconds the bot stays in the voice channel when nobody is listening, 0 disables it
+	AloneTimeout int `envconfig:"ALONE_TIMEOUT"`
+	// ReconnectAttempts is how many times the bot tries to reconnect to its voice channel after losing the connection
+	ReconnectAttempts int `envconfig:"RECONNECT_ATTEMPTS"`
+	// Language is the language of the messages, it must be en or have a catalog in LocalesPath
+	Language string `envconfig:"LANGUAGE"`
+	// LocalesPath is the directory that holds the message catalogs, one <language>.json file per language
+	LocalesPath string `envconfig:"LOCALES_PATH"`
+	// Messages overrides the messages of the commands, keyed by the command's name and then by the message's key
+	Messages messageOverrides `envconfig:"MESSAGES"`
+	// MessagesPath is the file that holds the messages that guilds set with the setmessage command
+	MessagesPath string `envconfig:"MESSAGES_PATH"`
+	// AliasesPath is the file that holds the aliases that guilds added with the alias command
+	AliasesPath string `envconfig:"ALIASES_PATH"`
+	// Audio holds the encoder settings of every guild
+	Audio AudioConfig `envconfig:"AUDIO"`
+	// Guilds holds the settings of specific guilds, keyed by the guild's id
+	Guilds map[string]GuildConfig `envconfig:"GUILDS"`
+	// Shards is how many shards of the gateway the bot connects with, 0 uses the shards that discord recommends
+	Shards int `envconfig:"SHARDS"`
+	// API holds the settings of the http api
+	API APIConfig `envconfig:"API"`
+	// ShutdownTimeout is how many seconds the bot takes at most to shut down, what didn't finish by then is cut off
+	ShutdownTimeout int `envconfig:"SHUTDOWN_TIMEOUT"`
+	// LogLevel is the lowest level that is logged, one of trace, debug, info, warn or error
+	LogLevel string `envconfig:"LOG_LEVEL"`
+	// LogFormat is how the logs are written, text or json
+	LogFormat string `envconfig:"LOG_FORMAT"`
+	// MetricsAddress is where prometheus metrics are served on /metrics, i.e :9090. They are disabled if it's empty.
+	MetricsAddress string `envconfig:"METRICS_ADDRESS"`
+}
+
+// APIConfig holds the settings of the http api that controls the players
+type APIConfig struct {
+	// Address is where the api listens, i.e :8080. The api is disabled if it's empty.
+	Address string `envconfig:"ADDRESS"`
+	// Token must be sent as a bearer token with every request, it's required when Address is set
+	Token string `envconfig:"TOKEN"`
+	// Dashboard holds the settings of the web dashboard, it's served by the api
+	Dashboard DashboardConfig `envconfig:"DASHBOARD"`
+}
+
+// DashboardConfig holds the settings of the web dashboard, users log in with discord and only see the guilds they share with the bot
+type DashboardConfig struct {
+	// Enabled serves the dashboard on / of the api's address
+	Enabled bool `envconfig:"ENABLED"`
+	// ClientID and ClientSecret are the OAuth2 credentials of the bot's discord application
+	ClientID     string `envconfig:"CLIENT_ID"`
+	ClientSecret string `envconfig:"CLIENT_SECRET"`
+	// RedirectURL is the public url of /auth/callback, it must be one of the redirects of the discord application
+	RedirectURL string `envconfig:"REDIRECT_URL"`
+	// DevLogin logs everybody on the computer of the bot in as DevUser without discord, and gives them every guild of the bot.
+	// It's only meant for development, behind a proxy on the same computer it would let anybody in.
+	DevLogin bool   `envconfig:"DEV_LOGIN"`
+	DevUser  string `envconfig:"DEV_USER"`
+}
+
+// GuildConfig overrides the settings of Config for a single guild
+type GuildConfig struct {
+	// Audio overrides the values of Config.Audio that are set
+	Audio AudioConfig `envconfig:"AUDIO"`
+	// AlwaysOn keeps the bot in the voice channel 24/7, even when it's idle or alone
+	AlwaysOn bool `envconfig:"ALWAYS_ON"`
+	// Language overrides Config.Language
+	Language string `envconfig:"LANGUAGE"`
+	// Messages overrides Config.Messages
+	Messages messageOverrides `envconfig:"MESSAGES"`
+	// Aliases are extra aliases of the guild, keyed by the alias. The values are the names of the commands.
+	Aliases map[string]string `envconfig:"ALIASES"`
+}
+
+// AudioConfig holds the settings of the opus encoder, zero values are not set.
+type AudioConfig struct {
+	// Bitrate sets the opus encoder bitrate (quality) value in kbps.
+	// Must be within 1 to 512 kbps, anything else isn't meaningful.
+	// Discord only uses 8 to 128 kbps, or up to 384 kbps in boosted servers, and default is 64 kbps.
+	Bitrate int `envconfig:"BITRATE"`
+
+	// FrameSize sets the opus encoder frame size value.
+	// The Frame Size is the length or amount of milliseconds each Opus frame
+	// will be.
+	// Must be 960 (20ms), discord sends a frame every 20ms so longer frames would play at the wrong speed.
+	FrameSize int `envconfig:"FRAME_SIZE"`
+
+	// Channels sets the ops encoder channel value.
+	// Must be set to 1 for mono, 2 for stereo
+	Channels int `envconfig:"CHANNELS"`
+
+	// Application sets the opus encoder Application value.
+	// Must be one of voip, audio, or lowdelay.
+	// DCA defaults to audio which is ideal for music.
+	// Not sure what Discord uses here, probably voip.
+	Application string `envconfig:"APPLICATION"`
+
+	// MaxBitrate caps the bitrate in kbps when the encoder matches the bitrate of the voice channel.
+	// Must be within 1 to 512 kbps, 0 keeps Bitrate no matter what the channel's bitrate is.
+	MaxBitrate int `envconfig:"MAX_BITRATE"`
+
+	// BufferSize is used when downloading the youtube video so that ffmpeg doesn't over-reach while transcoding, in bytes.
+	// Must be at least 4096 bytes, default is 512 KB.
+	BufferSize int `envconfig:"BUFFER_SIZE"`
+}
+
+// audioApplications maps the values of AudioConfig.Application to the opus applications
+var audioApplications = map[string]opus.Application{
+	"voip":     opus.AppVoIP,
+	"audio":    opus.AppAudio,
+	"lowdelay": opus.AppRestrictedLowdelay,
+}
+
+// override returns a copy of a with the values that are set in o.
+func (a AudioConfig) override(o AudioConfig) AudioConfig {
+	if o.Bitrate != 0 {
+		a.Bitrate = o.Bitrate
+	}
+
+	if o.FrameSize != 0 {
+		a.FrameSize = o.FrameSize
+	}
+
+	if o.Channels != 0 {
+		a.Channels = o.Channels
+	}
+
+	if o.Application != "" {
+		a.Application = o.Application
+	}
+
+	if o.MaxBitrate != 0 {
+		a.MaxBitrate = o.MaxBitrate
+	}
+
+	if o.BufferSize != 0 {
+		a.BufferSize = o.BufferSize
+	}
+
+	return a
+}
+
+// validate returns an error if one of the values that are set isn't allowed.
+func (a AudioConfig) validate() error {
+	if a.Bitrate != 0 && (a.Bitrate < 1 || a.Bitrate > 512) {
+		return fmt.Errorf("bitrate must be within 1 to 512 kbps, not %d", a.Bitrate)
+	}
+
+	if a.MaxBitrate != 0 && (a.MaxBitrate < 1 || a.MaxBitrate > 512) {
+		return fmt.Errorf("maxBitrate must be within 1 to 512 kbps, not %d", a.MaxBitrate)
+	}
+
+	if a.FrameSize != 0 && a.FrameSize != 960 {
+		return fmt.Errorf("frameSize must be 960, discord only takes frames of 20ms, not %d", a.FrameSize)
+	}
+
+	if a.Channels != 0 && a.Channels != 1 && a.Channels != 2 {
+		return fmt.Errorf("channels must be 1 or 2, not %d", a.Channels)
+	}
+
+	if _, ok := audioApplications[a.Application]; a.Application != "" && !ok {
+		return fmt.Errorf("application must be one of voip, audio or lowdelay, not %q", a.Application)
+	}
+
+	if a.BufferSize != 0 && a.BufferSize < 4096 {
+		return fmt.Errorf("bufferSize must be at least 4096 bytes, not %d", a.BufferSize)
+	}
+
+	return nil
+}
+
+// validate returns an error if one of the log, audio, message, alias or api settings isn't allowed.
+func (c Config) validate() error {
+	if _, ok := logLevels[c.LogLevel]; !ok {
+		return fmt.Errorf("logLevel must be one of trace, debug, info, warn or error, not %q", c.LogLevel)
+	}
+
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		return fmt.Errorf("logFormat must be text or json, not %q", c.LogFormat)
+	}
+
+	seen := map[string]bool{}
+	for _, token := range c.tokens() {
+		if seen[token] {
+			return fmt.Errorf("botTokens must be different from each other and from botToken")
+		}
+
+		seen[token] = true
+	}
+
+	if c.Shards < 0 {
+		return fmt.Errorf("shards must be at least 0, not %d", c.Shards)
+	}
+
+	if c.API.Address != "" && c.API.Token == "" {
+		return fmt.Errorf("api.token must be set when api.address is")
+	}
+
+	if d := c.API.Dashboard; d.Enabled {
+		if c.API.Address == "" {
+			return fmt.Errorf("api.address must be set when api.dashboard.enabled is")
+		}
+
+		if d.DevLogin && d.DevUser == "" {
+			return fmt.Errorf("api.dashboard.devUser must be set when api.dashboard.devLogin is")
+		}
+
+		if !d.DevLogin && (d.ClientID == "" || d.ClientSecret == "" || d.RedirectURL == "") {
+			return fmt.Errorf("api.dashboard needs clientId, clientSecret and redirectUrl, or devLogin")
+		}
+	}
+
+	err := c.Audio.validate()
+	if err != nil {
+		return fmt.Errorf("audio: %w", err)
+	}
+
+	err = c.Messages.validate()
+	if err != nil {
+		return fmt.Errorf("messages.%w", err)
+	}
+
+	for id, guild := range c.Guilds {
+		err = guild.Audio.validate()
+		if err != nil {
+			return fmt.Errorf("guilds.%s.audio: %w", id, err)
+		}
+
+		err = guild.Messages.validate()
+		if err != nil {
+			return fmt.Errorf("guilds.%s.messages.%w", id, err)
+		}
+
+		err = validatealiases(guild.Aliases)
+		if err != nil {
+			return fmt.Errorf("guilds.%s.aliases.%w", id, err)
+		}
+	}
+
+	return nil
 }
 
-var config Config
+// tokens returns the token of every bot, BotToken comes first.
+func (c Config) tokens() []string {
+	var tokens []string
+	if len(c.BotToken) > 0 {
+		tokens = append(tokens, c.BotToken)
+	}
+
+	return append(tokens, c.BotTokens...)
+}
+
+// guildAudio returns the audio settings of a guild, with its overrides applied.
+func (c Config) guildAudio(guildID string) AudioConfig {
+	audio := c.Audio
+	if guild, ok := c.Guilds[guildID]; ok {
+		audio = audio.override(guild.Audio)
+	}
+
+	return audio
+}
+
+// alwaysOn returns true if the bot should never leave the voice channel of a guild by itself.
+func (c Config) alwaysOn(guildID string) bool {
+	return c.Guilds[guildID].AlwaysOn
+}
+
+// language returns the language of the messages of a guild.
+func (c Config) language(guildID string) string {
+	if lang := c.Guilds[guildID].Language; lang != "" {
+		return lang
+	}
+
+	return c.Language
+}
+
+// loadedConfig is a config and the message catalogs that have been loaded from its LocalesPath.
+type loadedConfig struct {
+	config   *Config
+	catalogs map[string]catalog
+}
+
+// configCurrent holds the current loadedConfig, reloadconfig replaces it while the commands and the players read it
+var configCurrent atomic.Value
+
+func init() {
+	configCurrent.Store(loadedConfig{config: &Config{}, catalogs: map[string]catalog{}})
+}
+
+// getconfig returns the config that the bot runs with. It's shared, so it's never changed but replaced with setconfig.
+func getconfig() *Config {
+	return configCurrent.Load().(loadedConfig).config
+}
+
+// getcatalogs returns the message catalogs of the config, keyed by their language.
+func getcatalogs() map[string]catalog {
+	return configCurrent.Load().(loadedConfig).catalogs
+}
+
+// setconfig replaces the config and its message catalogs.
+func setconfig(c *Config, cats map[string]catalog) {
+	configCurrent.Store(loadedConfig{config: c, catalogs: cats})
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestAudioConfigValidate(t *testing.T) {
+	for size, valid := range map[int]bool{0: true, 960: true, 480: false, 1920: false, 2880: false} {
+		err := AudioConfig{FrameSize: size}.validate()
+		if valid != (err == nil) {
+			t.Errorf("frameSize %d: got %v", size, err)
+		}
+	}
+}
+
+func TestDashboardConfigValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		d     DashboardConfig
+		valid bool
+	}{
+		{"oauth2", DashboardConfig{Enabled: true, ClientID: "1", ClientSecret: "secret", RedirectURL: "https://example.com/auth/callback"}, true},
+		{"dev login", DashboardConfig{Enabled: true, DevLogin: true, DevUser: "1"}, true},
+		{"dev user without the dev login", DashboardConfig{Enabled: true, DevUser: "1"}, false},
+		{"dev login without a user", DashboardConfig{Enabled: true, DevLogin: true}, false},
+	} {
+		c := Config{LogLevel: "info", LogFormat: "text", API: APIConfig{Address: ":8080", Token: "token", Dashboard: tt.d}}
+		if err := c.validate(); tt.valid != (err == nil) {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	ytdl "github.com/kkdai/youtube/v2"
+)
+
+var (
+	consoleFlag = flag.Bool("console", false, "Read the commands from stdin and write the audio to -output, without discord")
+	outputFlag  = flag.String("output", "console.ogg", "The file that the console writes the audio to, - is stdout")
+	formatFlag  = flag.String("format", "", "The format of -output, ogg or wav. By default it's wav for .wav files and ogg otherwise")
+)
+
+// The ids of the guild of the console, they are numbers like the ids of discord so that the arguments can parse them
+const (
+	consoleGuildID = "1"
+	consoleTextID  = "2"
+	consoleVoiceID = "3"
+	consoleUserID  = "4"
+	consoleBotID   = "5"
+)
+
+// consoleSession is the session of the console, it prints the messages and writes the audio of its voice connection to a sink.
+// Its state holds a guild with a text and a voice channel, the user of the console owns the guild and is in the voice channel.
+type consoleSession struct {
+	st     *discordgo.State
+	author *discordgo.User
+
+	out   io.Writer
+	outMu sync.Mutex
+
+	// file is where sink writes to, it's os.Stdout when the output is -
+	file   *os.File
+	sink   audioSink
+	sinkMu sync.Mutex
+
+	// done is closed once the input is over and the queue finished
+	done chan struct{}
+}
+
+// runconsole runs the console with the flags, until stdin is over and the queue finished or the process is interrupted.
+func runconsole() error {
+	out := io.Writer(os.Stdout)
+	// The messages would end up in the audio
+	if *outputFlag == "-" {
+		out = os.Stderr
+	}
+
+	c, err := startconsole(os.Stdin, out, *outputFlag, *formatFlag)
+	if err != nil {
+		return err
+	}
+
+	waitforshutdown(c.done)
+	return c.close()
+}
+
+// startconsole runs the commands of in as the messages of the console's guild, and prints the messages of the bot to out.
+// The audio is written to the file output in format, an empty format is picked from the extension of output.
+// The play command plays local files instead of searching youtube.
+func startconsole(in io.Reader, out io.Writer, output, format string) (*consoleSession, error) {
+	if format == "" {
+		format = "ogg"
+		if strings.EqualFold(filepath.Ext(output), ".wav") {
+			format = "wav"
+		}
+	}
+
+	file := os.Stdout
+	if output != "-" {
+		var err error
+		file, err = os.Create(output)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sink, err := newsink(format, file, getconfig().Audio)
+	if err != nil {
+		if file != os.Stdout {
+			file.Close()
+		}
+		return nil, err
+	}
+
+	c := &consoleSession{
+		st:     newconsolestate(),
+		author: &discordgo.User{ID: consoleUserID, Username: "console", Discriminator: "0000"},
+		out:    out,
+		file:   file,
+		sink:   sink,
+		done:   make(chan struct{}),
+	}
+
+	b := &bot{concurrency: 1, players: map[string]*player{}}
+	bots = []*bot{b}
+
+	findvideo = findlocalfile
+
+	go c.read(b, in)
+
+	logs.with("output", output).with("format", format).infof("The console reads the commands from stdin")
+	return c, nil
+}
+
+// newconsolestate returns the state with the guild of the console.
+func newconsolestate() *discordgo.State {
+	st := discordgo.NewState()
+	st.User = &discordgo.User{ID: consoleBotID, Username: "musicbot", Bot: true}
+
+	user := &discordgo.User{ID: consoleUserID, Username: "console"}
+	st.GuildAdd(&discordgo.Guild{
+		ID:      consoleGuildID,
+		Name:    "Console",
+		OwnerID: consoleUserID,
+		// The role of everyone has the id of the guild, the bot cannot send embeds so that the messages are plain text
+		Roles: []*discordgo.Role{{ID: consoleGuildID}},
+		Channels: []*discordgo.Channel{
+			{ID: consoleTextID, GuildID: consoleGuildID, Name: "console", Type: discordgo.ChannelTypeGuildText},
+			{ID: consoleVoiceID, GuildID: consoleGuildID, Name: "output", Type: discordgo.ChannelTypeGuildVoice, Bitrate: 64000},
+		},
+		Members: []*discordgo.Member{
+			{GuildID: consoleGuildID, User: st.User},
+			{GuildID: consoleGuildID, User: user},
+		},
+		VoiceStates: []*discordgo.VoiceState{
+			{GuildID: consoleGuildID, UserID: consoleUserID, ChannelID: consoleVoiceID},
+		},
+	})
+
+	return st
+}
+
+// read runs every line of in as a command, and closes c.done once in is over and the queue finished.
+func (c *consoleSession) read(b *bot, in io.Reader) {
+	sc := bufio.NewScanner(in)
+	for id := 1; sc.Scan(); id++ {
+		line := strings.TrimSpace(sc.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		// Every line is a command, so the prefix can be left out
+		if prefix := getconfig().Prefix; !strings.HasPrefix(line, prefix) {
+			line = prefix + line
+		}
+
+		b.handlemessage(c, &discordgo.MessageCreate{Message: &discordgo.Message{
+			ID:        strconv.Itoa(id),
+			GuildID:   consoleGuildID,
+			ChannelID: consoleTextID,
+			Content:   line,
+			Author:    c.author,
+		}})
+
+		// The commands run one after the other, so that the lines run like a script
+		runningCommands.Wait()
+	}
+
+	if err := sc.Err(); err != nil {
+		logs.err(err).errorf("Cannot read the commands")
+	}
+
+	for !consoleidle(b) {
+		time.Sleep(time.Second)
+	}
+
+	close(c.done)
+}
+
+// consoleidle returns true once nothing is playing and the queue is over, or the player left the voice channel.
+func consoleidle(b *bot) bool {
+	p := b.findplayer(consoleGuildID)
+	if p == nil {
+		return true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.playingAudio {
+		return false
+	}
+
+	return p.vc == nil || p.queueindex < 0 || p.queueindex >= len(p.queue)
+}
+
+// close finishes the audio and closes the file.
+func (c *consoleSession) close() error {
+	c.sinkMu.Lock()
+	defer c.sinkMu.Unlock()
+
+	err := c.sink.Close()
+	c.sink = nil
+
+	if c.file != os.Stdout {
+		cerr := c.file.Close()
+		if err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// writeframe writes a frame of the voice connection to the sink, the frames are dropped once the console is closed.
+func (c *consoleSession) writeframe(frame []byte) {
+	c.sinkMu.Lock()
+	defer c.sinkMu.Unlock()
+
+	if c.sink == nil {
+		return
+	}
+
+	err := c.sink.WriteFrame(frame)
+	if err != nil {
+		logs.err(err).warnf("Cannot write the audio")
+	}
+}
+
+// println prints a message of the bot.
+func (c *consoleSession) println(str string) {
+	c.outMu.Lock()
+	fmt.Fprintln(c.out, str)
+	c.outMu.Unlock()
+}
+
+func (c *consoleSession) ChannelMessageSend(channelID string, content string, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	c.println(content)
+	return &discordgo.Message{ChannelID: channelID, Content: content}, nil
+}
+
+func (c *consoleSession) ChannelMessageSendEmbed(channelID string, embed *discordgo.MessageEmbed, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	return c.ChannelMessageSendEmbeds(channelID, []*discordgo.MessageEmbed{embed}, options...)
+}
+
+func (c *consoleSession) ChannelMessageSendEmbeds(channelID string, embeds []*discordgo.MessageEmbed, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	for _, embed := range embeds {
+		lines := []string{}
+		if embed.Author != nil {
+			lines = append(lines, embed.Author.Name)
+		}
+
+		for _, str := range []string{embed.Title, embed.Description} {
+			if len(str) > 0 {
+				lines = append(lines, str)
+			}
+		}
+
+		for _, field := range embed.Fields {
+			lines = append(lines, field.Name+": "+field.Value)
+		}
+
+		if embed.Footer != nil {
+			lines = append(lines, embed.Footer.Text)
+		}
+
+		c.println(strings.Join(lines, "\n"))
+	}
+
+	return &discordgo.Message{ChannelID: channelID, Embeds: embeds}, nil
+}
+
+// UserChannelCreate returns the text channel, the direct messages are printed like every other message.
+func (c *consoleSession) UserChannelCreate(recipientID string, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	return c.st.Channel(consoleTextID)
+}
+
+func (c *consoleSession) UserChannelPermissions(userID, channelID string, options ...discordgo.RequestOption) (int64, error) {
+	return c.st.UserChannelPermissions(userID, channelID)
+}
+
+// UserUpdate changes the name of the bot, the avatar is ignored.
+func (c *consoleSession) UserUpdate(username, avatar string, options ...discordgo.RequestOption) (*discordgo.User, error) {
+	if len(username) > 0 {
+		c.st.User.Username = username
+	}
+
+	return c.st.User, nil
+}
+
+func (c *consoleSession) state() guildState {
+	return c.st
+}
+
+func (c *consoleSession) user() *discordgo.User {
+	return c.st.User
+}
+
+func (c *consoleSession) joinvoice(guildID, channelID string) (voiceConnection, error) {
+	v := &consoleVoice{
+		c:         c,
+		channelID: channelID,
+		send:      make(chan []byte, 2),
+		closed:    make(chan struct{}),
+	}
+
+	go v.receive()
+	return v, nil
+}
+
+// consoleVoice is the voice connection of the console, it writes the frames to the sink as fast as discord would send them.
+type consoleVoice struct {
+	c    *consoleSession
+	send chan []byte
+
+	mu        sync.Mutex
+	channelID string
+	closed    chan struct{}
+}
+
+// receive writes the frames that the player sends, and waits for each of them to be over before taking the next one.
+func (v *consoleVoice) receive() {
+	next := time.Now()
+	for {
+		select {
+		case frame := <-v.send:
+			v.c.writeframe(frame)
+
+			d := opusFrameDuration(frame)
+			if d == 0 {
+				d = discordFrameDuration
+			}
+
+			next = next.Add(d)
+			wait := time.Until(next)
+			if wait > 0 {
+				time.Sleep(wait)
+			} else {
+				// The player was paused or the song was loading, the next frame isn't late
+				next = time.Now()
+			}
+		case <-v.closed:
+			return
+		}
+	}
+}
+
+func (v *consoleVoice) ChangeChannel(channelID string, mute, deaf bool) error {
+	v.mu.Lock()
+	v.channelID = channelID
+	v.mu.Unlock()
+	return nil
+}
+
+func (v *consoleVoice) Speaking(speaking bool) error {
+	return nil
+}
+
+func (v *consoleVoice) Disconnect() error {
+	v.Close()
+	return nil
+}
+
+func (v *consoleVoice) Close() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	select {
+	case <-v.closed:
+	default:
+		close(v.closed)
+	}
+}
+
+func (v *consoleVoice) ready() bool {
+	select {
+	case <-v.closed:
+		return false
+	default:
+		return true
+	}
+}
+
+func (v *consoleVoice) opus() chan []byte {
+	return v.send
+}
+
+// findlocalfile finds the songs of the console, query is the path of a file that ffmpeg can read.
+func findlocalfile(query string) (*ytdl.Video, error) {
+	path, err := filepath.Abs(query)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return nil, errNoVideos
+	}
+
+	name := filepath.Base(path)
+	ext := filepath.Ext(name)
+
+	mime := "audio/" + strings.TrimPrefix(strings.ToLower(ext), ".")
+	// The frames of webm files are passed through if they are opus, the others are transcoded once that fails
+	if strings.EqualFold(ext, ".webm") {
+		mime = `audio/webm; codecs="opus"`
+	}
+
+	return &ytdl.Video{
+		ID:    strings.TrimSuffix(name, ext),
+		Title: name,
+		Formats: ytdl.FormatList{
+			{URL: fileScheme + path, MimeType: mime, ContentLength: info.Size()},
+		},
+	}, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConsole(t *testing.T) {
+	newtestbot(t)
+	writedca(t, "tune", "A Tune", 5)
+	t.Cleanup(func() {
+		findvideo = resolvevideo
+	})
+
+	output := filepath.Join(t.TempDir(), "out.ogg")
+	in := strings.NewReader("playdca tune\n\n" + getconfig().Prefix + "play missing.mp3\n")
+
+	var out bytes.Buffer
+	c, err := startconsole(in, &out, output, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-c.done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the queue to finish")
+	}
+
+	err = c.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "Added **A Tune** to the queue!\n" + msg("play", "empty") + "\n"
+	if out.String() != want {
+		t.Errorf("printed %q, want %q", out.String(), want)
+	}
+
+	data, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The headers, the frames of the song and the end
+	pages := readoggpages(t, data)
+	if len(pages) != 2+5+1 {
+		t.Errorf("wrote %d pages, want %d", len(pages), 2+5+1)
+	}
+}
+
+func TestFindLocalFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "song.webm")
+	err := ioutil.WriteFile(path, []byte("webm"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vid, err := findlocalfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vid.ID != "song" || vid.Title != "song.webm" || !islocal(vid) || !isopusformat(&vid.Formats[0]) {
+		t.Errorf("found %+v, want the local opus file song", vid)
+	}
+
+	for _, query := range []string{dir, filepath.Join(dir, "missing.mp3")} {
+		_, err = findlocalfile(query)
+		if err != errNoVideos {
+			t.Errorf("found %s: %v, want %v", query, err, errNoVideos)
+		}
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// dashboardFiles holds the html, css and javascript of the dashboard
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+const (
+	// dashboardCookie holds the id of the user's session
+	dashboardCookie = "musicbot_session"
+	// dashboardStateCookie holds the OAuth2 state while the user logs in with discord
+	dashboardStateCookie = "musicbot_state"
+	// dashboardSessionAge is how long a user stays logged in
+	dashboardSessionAge = 7 * 24 * time.Hour
+)
+
+// dashboardSession is a user that logged in to the dashboard.
+type dashboardSession struct {
+	user *discordgo.User
+	// guilds holds the ids of the user's guilds, nil gives every guild of the bot
+	guilds map[string]bool
+	// csrf must be sent as the X-CSRF-Token header with every request that changes something
+	csrf    string
+	expires time.Time
+}
+
+// canaccess returns true if the user is allowed to control the player of a guild.
+func (ds *dashboardSession) canaccess(guildID string) bool {
+	return ds.guilds == nil || ds.guilds[guildID]
+}
+
+var (
+	// dashboardSessions holds the users that are logged in, keyed by the session's id. They are lost on restart.
+	dashboardSessions   = map[string]*dashboardSession{}
+	dashboardSessionsMu sync.Mutex
+)
+
+// apiContextKey is the type of the keys that the api stores in the requests' context
+type apiContextKey int
+
+// apiSessionKey holds the dashboard session of a request, requests that use the api's token have none
+const apiSessionKey apiContextKey = iota
+
+// requestsession returns the dashboard session that a request was authenticated with, or nil.
+func requestsession(r *http.Request) *dashboardSession {
+	ds, _ := r.Context().Value(apiSessionKey).(*dashboardSession)
+	return ds
+}
+
+// randomtoken returns a random hex string, used for the ids of the sessions and the csrf and OAuth2 tokens.
+func randomtoken() string {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		// There is no safe way to continue without randomness
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// dashboardsession returns the session of the request's cookie, or nil if it has none or it expired.
+func dashboardsession(r *http.Request) *dashboardSession {
+	if !getconfig().API.Dashboard.Enabled {
+		return nil
+	}
+
+	cookie, err := r.Cookie(dashboardCookie)
+	if err != nil {
+		return nil
+	}
+
+	dashboardSessionsMu.Lock()
+	defer dashboardSessionsMu.Unlock()
+
+	ds, ok := dashboardSessions[cookie.Value]
+	if !ok {
+		return nil
+	}
+
+	if time.Now().After(ds.expires) {
+		delete(dashboardSessions, cookie.Value)
+		return nil
+	}
+
+	return ds
+}
+
+// newdashboardsession logs a user in and sets the cookie of the session.
+func newdashboardsession(w http.ResponseWriter, user *discordgo.User, guilds map[string]bool) {
+	id := randomtoken()
+	ds := &dashboardSession{
+		user:    user,
+		guilds:  guilds,
+		csrf:    randomtoken(),
+		expires: time.Now().Add(dashboardSessionAge),
+	}
+
+	dashboardSessionsMu.Lock()
+	// The expired sessions of the users that never came back are dropped here
+	for k, v := range dashboardSessions {
+		if time.Now().After(v.expires) {
+			delete(dashboardSessions, k)
+		}
+	}
+
+	dashboardSessions[id] = ds
+	dashboardSessionsMu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     dashboardCookie,
+		Value:    id,
+		Path:     "/",
+		Expires:  ds.expires,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(getconfig().API.Dashboard.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// adddashboard adds the dashboard's pages and the login with discord to mux.
+func adddashboard(mux *http.ServeMux) {
+	static, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		// The files are embedded, so this only fails if the directory is renamed
+		panic(err)
+	}
+
+	mux.Handle("/", http.FileServer(http.FS(static)))
+	mux.HandleFunc("/auth/login", dashboardLogin)
+	mux.HandleFunc("/auth/callback", dashboardCallback)
+	mux.HandleFunc("/auth/logout", dashboardLogout)
+	mux.HandleFunc("/auth/me", dashboardMe)
+}
+
+// dashboardLogin redirects the user to discord to log in, or logs them in as config.API.Dashboard.DevUser when
+// the dev login is enabled. The dev user is only given to the requests of the computer that the bot runs on.
+func dashboardLogin(w http.ResponseWriter, r *http.Request) {
+	d := getconfig().API.Dashboard
+	if d.DevLogin {
+		if !isloopback(r) {
+			http.Error(w, "The dev user can only log in from the computer of the bot", http.StatusForbidden)
+			return
+		}
+
+		user, err := sesh.User(d.DevUser)
+		if err != nil {
+			user = &discordgo.User{ID: d.DevUser, Username: d.DevUser}
+		}
+
+		newdashboardsession(w, user, nil)
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	state := randomtoken()
+	http.SetCookie(w, &http.Cookie{
+		Name:     dashboardStateCookie,
+		Value:    state,
+		Path:     "/auth/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(d.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	query := url.Values{
+		"client_id":     {d.ClientID},
+		"redirect_uri":  {d.RedirectURL},
+		"response_type": {"code"},
+		"scope":         {"identify guilds"},
+		"state":         {state},
+		"prompt":        {"none"},
+	}
+
+	http.Redirect(w, r, discordgo.EndpointOAuth2+"authorize?"+query.Encode(), http.StatusFound)
+}
+
+// warndevlogin warns that the dashboard lets anybody in as the dev user, if the dev login is enabled.
+func warndevlogin(d DashboardConfig) {
+	if d.Enabled && d.DevLogin {
+		logs.with("user", d.DevUser).warnf("The dashboard's dev login is enabled, everybody on this computer or behind a proxy on it can log in without discord")
+	}
+}
+
+// isloopback returns true if a request comes from the computer that the bot runs on.
+func isloopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// dashboardCallback finishes logging in with discord, the user gets access to the guilds that they share with the bot.
+func dashboardCallback(w http.ResponseWriter, r *http.Request) {
+	state, err := r.Cookie(dashboardStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(state.Value), []byte(r.URL.Query().Get("state"))) != 1 {
+		http.Error(w, "The login expired, try again", http.StatusBadRequest)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: dashboardStateCookie, Path: "/auth/", MaxAge: -1})
+
+	code := r.URL.Query().Get("code")
+	if len(code) == 0 {
+		// The user cancelled the login
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	token, err := oauth2token(ctx, code)
+	if err != nil {
+		logs.err(err).warnf("Cannot log in to the dashboard")
+		http.Error(w, "Cannot log in with discord", http.StatusBadGateway)
+		return
+	}
+
+	// The user's own token is used to ask discord who they are
+	us, err := discordgo.New("Bearer " + token)
+	if err != nil {
+		logs.err(err).warnf("Cannot log in to the dashboard")
+		http.Error(w, "Cannot log in with discord", http.StatusBadGateway)
+		return
+	}
+
+	user, err := us.User("@me", discordgo.WithContext(ctx))
+	if err != nil {
+		logs.err(err).warnf("Cannot get the user of the dashboard")
+		http.Error(w, "Cannot log in with discord", http.StatusBadGateway)
+		return
+	}
+
+	guilds, err := userguilds(ctx, us)
+	if err != nil {
+		logs.with("user", user.ID).err(err).warnf("Cannot get the guilds of the dashboard's user")
+		http.Error(w, "Cannot log in with discord", http.StatusBadGateway)
+		return
+	}
+
+	newdashboardsession(w, user, guilds)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// userGuildsLimit is the most guilds that discord returns at once
+const userGuildsLimit = 200
+
+// userguilds returns the ids of every guild of the user that us belongs to. Discord sorts the guilds by their id,
+// so the pages are fetched after the last guild of the previous page until a page isn't full.
+func userguilds(ctx context.Context, us *discordgo.Session) (map[string]bool, error) {
+	guilds := map[string]bool{}
+	after := ""
+	for {
+		page, err := us.UserGuilds(userGuildsLimit, "", after, discordgo.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range page {
+			guilds[v.ID] = true
+		}
+
+		if len(page) < userGuildsLimit {
+			return guilds, nil
+		}
+
+		after = page[len(page)-1].ID
+	}
+}
+
+// oauth2token exchanges the code that discord redirected the user with for the user's access token.
+func oauth2token(ctx context.Context, code string) (string, error) {
+	d := getconfig().API.Dashboard
+	form := url.Values{
+		"client_id":     {d.ClientID},
+		"client_secret": {d.ClientSecret},
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {d.RedirectURL},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discordgo.EndpointOAuth2+"token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("discord answered with %s", res.Status)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&body)
+	if err != nil {
+		return "", err
+	}
+
+	if len(body.AccessToken) == 0 {
+		return "", errors.New("discord didn't send an access token")
+	}
+
+	return body.AccessToken, nil
+}
+
+// dashboardLogout logs the user out.
+func dashboardLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if cookie, err := r.Cookie(dashboardCookie); err == nil {
+		dashboardSessionsMu.Lock()
+		delete(dashboardSessions, cookie.Value)
+		dashboardSessionsMu.Unlock()
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: dashboardCookie, Path: "/", MaxAge: -1})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// dashboardMe returns the user that is logged in, with the csrf token that the dashboard sends to the api.
+func dashboardMe(w http.ResponseWriter, r *http.Request) {
+	ds := dashboardsession(r)
+	if ds == nil {
+		apiwrite(w, http.StatusUnauthorized, map[string]string{"error": "not logged in"})
+		return
+	}
+
+	apiwrite(w, http.StatusOK, map[string]string{
+		"id":       ds.user.ID,
+		"username": ds.user.Username,
+		"avatar":   ds.user.AvatarURL("64"),
+		"csrf":     ds.csrf,
+	})
+}
+
+// apiGuilds lists the guilds of the bot that the request is allowed to control.
+func apiGuilds(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apiwrite(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	ds := requestsession(r)
+
+	// The guilds that several bots are in are only listed once
+	guilds := []map[string]string{}
+	seen := map[string]bool{}
+	for _, b := range bots {
+		for _, s := range b.shards {
+			s.State.RLock()
+			for _, v := range s.State.Guilds {
+				if seen[v.ID] || (ds != nil && !ds.canaccess(v.ID)) {
+					continue
+				}
+
+				seen[v.ID] = true
+				guilds = append(guilds, map[string]string{
+					"id":   v.ID,
+					"name": v.Name,
+					"icon": v.IconURL("64"),
+				})
+			}
+			s.State.RUnlock()
+		}
+	}
+
+	apiwrite(w, http.StatusOK, guilds)
+}
@@ -0,0 +1,246 @@
+"use strict";
+
+// The dashboard talks to the same api as the bot's other tools, the session's cookie authenticates it.
+let csrf = "";
+let guild = "";
+let state = null;
+let queue = [];
+let socket = null;
+
+const $ = (id) => document.getElementById(id);
+
+async function api(method, path, body) {
+	const res = await fetch("/api/guilds" + path, {
+		method: method,
+		headers: {"Content-Type": "application/json", "X-CSRF-Token": csrf},
+		body: body === undefined ? undefined : JSON.stringify(body),
+	});
+
+	const data = await res.json();
+	if (!res.ok) {
+		throw new Error(data.error);
+	}
+
+	return data;
+}
+
+// control sends a change to the player, the websocket's events update the page afterwards.
+async function control(method, path, body) {
+	try {
+		$("error").hidden = true;
+		await api(method, "/" + guild + path, body);
+	} catch (err) {
+		$("error").textContent = err.message;
+		$("error").hidden = false;
+	}
+}
+
+function formatduration(seconds) {
+	seconds = Math.round(seconds);
+	const m = Math.floor(seconds / 60);
+	const s = seconds % 60;
+	return String(m).padStart(2, "0") + ":" + String(s).padStart(2, "0");
+}
+
+function rendercurrent() {
+	const song = state.current;
+	$("title").textContent = song ? song.title : "Nothing is playing";
+	$("title").href = song && song.url ? song.url : "#";
+	$("author").textContent = song ? song.author : "";
+	$("thumbnail").hidden = !(song && song.thumbnail);
+	if (song && song.thumbnail) {
+		$("thumbnail").src = song.thumbnail;
+	}
+
+	renderprogress();
+
+	$("pause").textContent = state.paused ? "Resume" : "Pause";
+	$("volume").value = state.volume;
+	$("loop").value = state.loop;
+	$("shuffle").checked = state.shuffle;
+}
+
+function renderprogress() {
+	const song = state.current;
+	if (!song || !state.playing) {
+		$("bar").style.width = "0";
+		$("time").textContent = "";
+		return;
+	}
+
+	const percent = song.duration > 0 ? Math.min(100, state.position / song.duration * 100) : 0;
+	$("bar").style.width = percent + "%";
+	$("time").textContent = formatduration(state.position) + " / " + formatduration(song.duration);
+}
+
+function renderqueue() {
+	const list = $("queue");
+	list.textContent = "";
+
+	queue.forEach((song) => {
+		const item = document.createElement("li");
+		item.draggable = true;
+		if (state.current && state.current.index === song.index) {
+			item.className = "current";
+		}
+
+		const title = document.createElement("span");
+		title.textContent = song.title + " (" + formatduration(song.duration) + ") - " + song.requester;
+		item.appendChild(title);
+
+		const remove = document.createElement("button");
+		remove.textContent = "Remove";
+		remove.onclick = () => control("DELETE", "/queue/" + song.index);
+		item.appendChild(remove);
+
+		// Songs are reordered by dragging them onto the place they should move to
+		item.ondragstart = (e) => e.dataTransfer.setData("text/plain", String(song.index));
+		item.ondragover = (e) => {
+			e.preventDefault();
+			item.classList.add("dragover");
+		};
+		item.ondragleave = () => item.classList.remove("dragover");
+		item.ondrop = (e) => {
+			e.preventDefault();
+			item.classList.remove("dragover");
+
+			const from = Number(e.dataTransfer.getData("text/plain"));
+			if (from !== song.index) {
+				control("PATCH", "/queue/" + from, {index: song.index});
+			}
+		};
+
+		list.appendChild(item);
+	});
+}
+
+// onevent applies an event of the player's websocket to the page.
+function onevent(ev) {
+	switch (ev.type) {
+	case "state":
+		state = ev.data;
+		break;
+	case "trackStarted":
+		state.current = ev.data.song;
+		state.position = ev.data.position;
+		state.playing = true;
+		state.paused = false;
+		break;
+	case "trackEnded":
+		state.playing = false;
+		break;
+	case "queueChanged":
+		queue = ev.data;
+		state.queueLength = queue.length;
+		break;
+	case "paused":
+		state.paused = true;
+		break;
+	case "resumed":
+		state.paused = false;
+		break;
+	case "volumeChanged":
+		state.volume = ev.data;
+		break;
+	case "loopChanged":
+		state.loop = ev.data;
+		break;
+	case "shuffleChanged":
+		state.shuffle = ev.data;
+		break;
+	case "voiceJoined":
+		state.channel = ev.data.channel;
+		break;
+	case "voiceLeft":
+		state.channel = "";
+		state.playing = false;
+		break;
+	}
+
+	rendercurrent();
+	renderqueue();
+}
+
+async function selectguild(id) {
+	guild = id;
+	localStorage.setItem("guild", id);
+
+	if (socket) {
+		socket.onclose = null;
+		socket.close();
+	}
+
+	queue = await api("GET", "/" + id + "/queue");
+
+	const scheme = location.protocol === "https:" ? "wss://" : "ws://";
+	socket = new WebSocket(scheme + location.host + "/api/guilds/" + id + "/events");
+	socket.onmessage = (msg) => onevent(JSON.parse(msg.data));
+	// The connection is opened again when it drops, i.e when the bot restarts
+	socket.onclose = () => setTimeout(() => selectguild(id), 5000);
+}
+
+async function start() {
+	const me = await fetch("/auth/me");
+	if (!me.ok) {
+		$("login").hidden = false;
+		return;
+	}
+
+	const user = await me.json();
+	csrf = user.csrf;
+	$("username").textContent = user.username;
+	$("avatar").src = user.avatar;
+	$("user").hidden = false;
+
+	const guilds = await api("GET", "");
+	if (guilds.length === 0) {
+		$("error").textContent = "You don't share any server with the bot.";
+		$("error").hidden = false;
+		$("player").hidden = false;
+		return;
+	}
+
+	const select = $("guilds");
+	guilds.forEach((g) => {
+		const option = document.createElement("option");
+		option.value = g.id;
+		option.textContent = g.name;
+		select.appendChild(option);
+	});
+
+	const saved = localStorage.getItem("guild");
+	select.value = guilds.some((g) => g.id === saved) ? saved : guilds[0].id;
+	select.onchange = () => selectguild(select.value);
+	select.hidden = false;
+
+	$("player").hidden = false;
+	await selectguild(select.value);
+}
+
+$("logout").onclick = async () => {
+	await fetch("/auth/logout", {method: "POST"});
+	location.reload();
+};
+
+$("pause").onclick = () => control("POST", state.paused ? "/resume" : "/pause");
+$("skip").onclick = () => control("POST", "/skip");
+$("clear").onclick = () => control("DELETE", "/queue");
+$("volume").onchange = () => control("POST", "/volume", {volume: Number($("volume").value)});
+$("loop").onchange = () => control("POST", "/loop", {mode: $("loop").value});
+$("shuffle").onchange = () => control("POST", "/shuffle", {shuffle: $("shuffle").checked});
+
+$("search").onsubmit = async (e) => {
+	e.preventDefault();
+	await control("POST", "/queue", {query: $("query").value});
+	$("query").value = "";
+};
+
+// The position moves by itself between the events
+setInterval(() => {
+	if (state && state.playing && !state.paused) {
+		state.position++;
+		renderprogress();
+	}
+}, 1000);
+
+start();
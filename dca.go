@@ -2,222 +2,653 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
-	"math/rand"
 	"os/exec"
+	"strconv"
 	"sync"
 	"time"
 
 	"gopkg.in/hraban/opus.v2"
 )
 
-type ChannelReadWriter struct {
-	data io.ReadWriter
-	ch   chan struct{}
+const (
+	// AudioFrameRate sets the opus encoder Frame Rate value.
+	// Must be one of 8000, 12000, 16000, 24000, or 48000.
+	// Discord only uses 48000 currently.
+	audioFrameRate = 48000
+
+	// maxFrameSize is the biggest amount of samples per channel that an opus frame can hold, which is 60ms.
+	maxFrameSize = 2880
+)
+
+var (
+	// AudioFilename is the filename for the song to be downloaded to.
+	audioFilename = "song.mp3"
+	// DcaFilename is the filename that the opus frames of the current song are recorded to, prefixed by the guild's id.
+	// It gets renamed to the video's id once the song has been fully played.
+	dcaFilename = "song.dca"
+)
+
+// maxBytes returns a calculated value of the largest possible size that an
+// opus frame could be.
+func (a AudioConfig) maxBytes() int {
+	return a.FrameSize * a.Channels
 }
 
-func NewCRW(rd int) *ChannelReadWriter {
-	if rd == 0 {
-		rd = bufferSize
-	}
+// pcmBufferSize returns how much of ffmpeg's output is buffered, it holds a second of pcm.
+// ffmpeg stops decoding whenever the buffer is full.
+func (a AudioConfig) pcmBufferSize() int {
+	return audioFrameRate * a.Channels * 2
+}
+
+// frameDuration returns how long a frame that is encoded with these settings is.
+func (a AudioConfig) frameDuration() time.Duration {
+	return time.Duration(a.FrameSize) * time.Second / audioFrameRate
+}
+
+// pcmstream is the raw pcm output of an ffmpeg process. ffmpeg writes into a pipe that is
+// read through a buffer of pcmBufferSize, so when the buffer is full ffmpeg blocks
+// instead of decoding the whole song into memory.
+type pcmstream struct {
+	ff  *exec.Cmd
+	out *bufio.Reader
+	// closer is closed before waiting for ffmpeg, so that the goroutine copying into stdin stops.
+	closer io.Closer
+
+	frame []byte
+	// done is set once ffmpeg exited, err is the error it exited with.
+	done bool
+	err  error
+}
 
-	buf := bytes.NewBuffer(nil)
-	return &ChannelReadWriter{data: bufio.NewReadWriter(bufio.NewReaderSize(buf, rd), bufio.NewWriterSize(buf, bufferSize))}
+var (
+	// ffmpegRunning holds the ffmpeg processes that are running, so that they can be killed on shutdown
+	ffmpegRunning   = map[*exec.Cmd]struct{}{}
+	ffmpegRunningMu sync.Mutex
+)
+
+// killffmpeg kills every ffmpeg process that is still running.
+func killffmpeg() {
+	ffmpegRunningMu.Lock()
+	defer ffmpegRunningMu.Unlock()
+
+	for ff := range ffmpegRunning {
+		ff.Process.Kill()
+	}
 }
 
-func (c *ChannelReadWriter) Write(b []byte) (int, error) {
-	n, err := c.data.Write(b)
-	if c.ch != nil {
-		fmt.Println("ch")
-		c.ch <- struct{}{}
-		fmt.Println("ch <-")
+// startffmpeg starts an ffmpeg process that converts input to raw pcm, with the settings of audio.
+// input is closed once the stream gets closed.
+func startffmpeg(input io.ReadCloser, audio AudioConfig) (*pcmstream, error) {
+	// A process that starts now might not be killed before the bot exits
+	if isshuttingdown() {
+		return nil, errShuttingDown
 	}
 
-	return n, err
+	ff := exec.Command("ffmpeg", "-y", "-nostdin", "-i", "-", "-f", "s16le",
+		"-ar", fmt.Sprintf("%d", audioFrameRate),
+		"-ac", fmt.Sprintf("%d", audio.Channels),
+		"-")
+
+	ff.Stdin = bufio.NewReaderSize(input, audio.BufferSize)
+
+	stdout, err := ff.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	err = ff.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	ffmpegRunningMu.Lock()
+	ffmpegRunning[ff] = struct{}{}
+	ffmpegRunningMu.Unlock()
+
+	return &pcmstream{
+		ff:     ff,
+		out:    bufio.NewReaderSize(stdout, audio.pcmBufferSize()),
+		closer: input,
+		frame:  make([]byte, audio.maxBytes()*2),
+	}, nil
 }
 
-func (c *ChannelReadWriter) Read(b []byte) (int, error) {
-	n, err := c.data.Read(b)
+// Prebuffer blocks until the buffer is full or ffmpeg exited.
+func (p *pcmstream) Prebuffer() {
+	p.out.Peek(p.out.Size())
+}
+
+// ReadFrame blocks until a whole frame of pcm is available, and decodes it into pcm.
+// The last frame of a song is padded with silence. Once ffmpeg exited, it returns io.EOF
+// if ffmpeg exited successfully, or the error it exited with.
+func (p *pcmstream) ReadFrame(pcm []int16) error {
+	if p.done {
+		return p.result()
+	}
+
+	frame := p.frame[:len(pcm)*2]
+	n, err := io.ReadFull(p.out, frame)
+	if err == io.EOF || (err == io.ErrUnexpectedEOF && n < 2) {
+		// The pipe only gets closed when ffmpeg exits
+		p.wait()
+		return p.result()
+	} else if err == io.ErrUnexpectedEOF {
+		for k := n; k < len(frame); k++ {
+			frame[k] = 0
+		}
+	} else if err != nil {
+		return err
+	}
+
+	for k := range pcm {
+		pcm[k] = int16(binary.LittleEndian.Uint16(frame[k*2:]))
+	}
 
-	return n, err
+	return nil
 }
 
-var (
-	// BufferSize is used when downloading the youtube video so that ffmpeg doesn't over-reach while transcoding. Currently set to 512 KB.
-	bufferSize = 1024 * 512
-	// AudioChannels sets the ops encoder channel value.
-	// Must be set to 1 for mono, 2 for stereo
-	audioChannels = 2
+func (p *pcmstream) result() error {
+	if p.err != nil {
+		return p.err
+	}
 
-	// AudioFrameRate sets the opus encoder Frame Rate value.
-	// Must be one of 8000, 12000, 16000, 24000, or 48000.
-	// Discord only uses 48000 currently.
-	audioFrameRate = 48000
+	return io.EOF
+}
 
-	// AudioBitrate sets the opus encoder bitrate (quality) value.
-	// Must be within 500 to 512000 bits per second are meaningful.
-	// Discord only uses 8000 to 128000 and default is 64000.
-	audioBitrate = 64
+// wait waits for ffmpeg to exit, and closes the input.
+func (p *pcmstream) wait() {
+	if p.done {
+		return
+	}
 
-	// AudioApplication sets the opus encoder Application value.
-	// Must be one of voip, audio, or lowdelay.
-	// DCA defaults to audio which is ideal for music.
-	// Not sure what Discord uses here, probably voip.
-	audioApplication = "audio"
+	p.closer.Close()
+	p.err = p.ff.Wait()
+	p.done = true
+	code := p.ff.ProcessState.ExitCode()
+	logs.with("code", code).err(p.err).debugf("ffmpeg exited")
 
-	// AudioFrameSize sets the opus encoder frame size value.
-	// The Frame Size is the length or amount of milliseconds each Opus frame
-	// will be.
-	// Must be one of 960 (20ms), 1920 (40ms), or 2880 (60ms)
-	audioFrameSize = 960
+	ffmpegRunningMu.Lock()
+	delete(ffmpegRunning, p.ff)
+	ffmpegRunningMu.Unlock()
 
-	// AudioFilename is the filename for the song to be downloaded to.
-	audioFilename = "song.mp3"
-	// DcaFilename is the filename that takes audioFilename and converts it to dca
-	dcaFilename = "song.dca"
+	metricFFmpegExits.inc(strconv.Itoa(code))
+}
 
-	// maxBytes is a calculated value of the largest possible size that an
-	// opus frame could be.
-	originalMaxBytes = (audioFrameSize * audioChannels)
+// Close kills ffmpeg if it is still running, and waits for it to exit.
+func (p *pcmstream) Close() error {
+	if !p.done && p.ff.Process != nil {
+		p.ff.Process.Kill()
+	}
 
-	// opusEncoder holds an instance of an gopus Encoder
-	opusEncoder *opus.Encoder
+	p.wait()
+	return nil
+}
 
-	// waitGroup is used to wait until all goroutines have finished.
-	waitGroup sync.WaitGroup
+// send reads the pcm that ffmpeg converted, encodes it with opus then sends it to the voice connection.
+// Every frame that is sent is also written to rec, if it isn't nil. The frames before start are skipped.
+// It returns true if the song has been played until the end.
+func (p *player) send(decoder *pcmstream, rec *dcaWriter, start time.Duration) bool {
+	vc := p.startsong()
+	defer p.finishsong()
 
-	encodeChan chan []int16
+	if vc != nil {
+		vc.Speaking(true)
+	}
 
-	// The perception of loudness from the intensity of the sound waves.
-	volume = float64(1.0)
+	frameduration := p.audio.frameDuration()
 
-	// The Rate at which the audio file is able to read.
-	playbackspeed = 100
+	buf := make([]int16, p.audio.maxBytes())
+	for {
+		vc, volume, paused := p.framestate()
+		if vc == nil {
+			break
+		}
 
-	// playingAudio is used to determine if currently a song is playing or not. It starts from the goroutine in main()
-	playingAudio bool
-)
+		p.applybitrate()
 
-// send reads from the converted opus file, then sends it to the voice connection
-func send(input io.Reader) {
-	qi := queueindex
-	defer func(qi int) {
-		if vc != nil {
-			vc.Speaking(false)
+		if paused {
+			// ffmpeg blocks once the buffer is full, until the song gets resumed
+			p.streaming = false
+			time.Sleep(time.Millisecond * 100)
+			continue
 		}
 
-		//log.Println("ran defer")
-		playingAudio = false
+		err := decoder.ReadFrame(buf)
+		if err == io.EOF {
+			// Okay! There's nothing left, time to quit.
+			p.log().debugf("ffmpeg reached the end of the song")
+			return true
+		} else if err != nil {
+			p.log().err(err).warnf("ffmpeg stopped before the end of the song")
+			break
+		}
 
-		// If the user didn't skip the song
-		if qi == queueindex {
+		if p.position < start {
+			p.advance(frameduration)
+			continue
+		}
 
-			// If shuffle is off and loop is not set to loop song
-			if shuffle == false && loop != loopSong {
-				// If the amount of songs exceeds the current song index, i.e
-				// amount of songs: 5, current song: 4, queueindex would become 5
-				if len(queue) > queueindex {
-					setqueueindex(queueindex + 1)
-				}
+		applyvolume(buf, volume)
 
-				// If the amount of songs is equal to the current song index, i.e
-				// amount of songs: 5, current song: 5, queueindex would become 0. starting over again.
-				if queueindex == len(queue) && loop == loopQueue {
-					setqueueindex(0)
-				}
-				// If shuffle is off and loop is not set to loop song
-			} else if shuffle == true && loop != loopSong {
-				// Array to hold all the songs' index that are left
-				arr := []int{}
-				for i := 0; i < len(queue); i++ {
-					if i == queueindex {
-						continue
-					}
-
-					arr = append(arr, i)
-				}
+		opus := make([]byte, p.audio.maxBytes())
 
-				// If there are more than 1 song in the array
-				if len(arr) > 1 {
-					// Set queue index to a random index that is equal to len(arr)-1
-					// this will give us a random song index that is not the song that has been played before.
-					setqueueindex(arr[rand.Intn(len(arr)-1)])
-				}
+		num, err := p.encoder.Encode(buf, opus)
+		if err == nil && num > 0 {
+			if logs.enabled(levelTrace) {
+				p.log().with("position", p.position).tracef("Sending a frame")
 			}
 
-			// If loop is set to loop song then replay it
-			if loop == loopSong {
-				setqueueindex(qi)
+			if !p.sendframe(vc, opus[:num]) {
+				break
 			}
 
+			p.advance(frameduration)
+			p.checkprefetch()
+
+			if rec != nil {
+				if volume != 1 {
+					// Otherwise the changed volume would be kept in the recording forever
+					rec.err = errRecordVolume
+				}
+
+				rec.WriteFrame(opus[:num])
+			}
+		} else {
+			break
 		}
+	}
+
+	return false
+}
+
+// startsong marks the current song as the one that is playing, and returns the voice connection that it's sent to.
+func (p *player) startsong() voiceConnection {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.playing = p.queueindex
+	p.position = 0
+	p.streaming = false
+	return p.vc
+}
+
+// framestate returns what the next frame of the song needs: the voice connection, the volume and whether the song is paused.
+// The voice connection is nil once the song has to stop, because it has been skipped, seeked or the player left.
+func (p *player) framestate() (voiceConnection, float64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.vc == nil || p.queueindex != p.playing || p.restart {
+		return nil, 0, false
+	}
 
-	}(qi)
+	return p.vc, p.volume, p.pause
+}
+
+// advance moves the position of the song by d, once a frame has been sent or skipped.
+// Only run() changes the position, so it reads it without the lock.
+func (p *player) advance(d time.Duration) {
+	p.mu.Lock()
+	p.position += d
+	p.mu.Unlock()
+}
+
+// applyvolume scales every sample of pcm by volume.
+func applyvolume(pcm []int16, volume float64) {
+	for k := range pcm {
+		pcm[k] = int16(math.Floor(float64(pcm[k]) * volume)) // Should work +/- values
+	}
+}
+
+// opusReader is implemented by sources that hold opus frames which can be sent without transcoding them.
+type opusReader interface {
+	// ReadFrame returns the next frame, or io.EOF when there are no frames left.
+	ReadFrame() ([]byte, error)
+}
+
+// sendopus streams opus frames from rd to the voice connection, without transcoding them through ffmpeg.
+// Frames are only re-encoded when the volume has been changed. Every frame that is sent unchanged
+// is also written to rec, if it isn't nil. frameduration is how long each frame is, the frames before start are skipped.
+// It returns true if the song has been played until the end.
+func (p *player) sendopus(rd opusReader, frameduration time.Duration, rec *dcaWriter, start time.Duration) bool {
+	vc := p.startsong()
+	defer p.finishsong()
 
 	if vc != nil {
 		vc.Speaking(true)
 	}
 
-	decoder := bytes.NewBuffer(nil)
-
-	ff := exec.Command("ffmpeg", "-y", "-nostdin", "-i", "-", "-f", "s16le",
-		"-ar", fmt.Sprintf("%d", audioFrameRate),
-		"-ac", fmt.Sprintf("%d", audioChannels),
-		"-")
+	var dec *opus.Decoder
+	for {
+		vc, volume, paused := p.framestate()
+		if vc == nil {
+			break
+		}
 
-	ff.Stdin = input
-	ff.Stdout = decoder
+		p.applybitrate()
 
-	ff.Start()
+		if paused {
+			p.streaming = false
+			time.Sleep(time.Millisecond * 100)
+			continue
+		}
 
-	time.Sleep(time.Second)
+		frame, err := rd.ReadFrame()
+		if err == io.EOF {
+			return true
+		} else if err != nil {
+			// The stream has been cut off, so the song isn't complete and isn't recorded
+			p.log().err(err).warnf("The stream stopped before the end of the song")
+			return false
+		}
 
-	defer func(ff *exec.Cmd) {
-		if ff.Process != nil {
-			ff.Process.Kill()
+		if p.position < start {
+			p.advance(frameduration)
+			continue
 		}
-	}(ff)
-	stop := false
-	go func() {
-		err := ff.Wait()
-		stop = true
-		fmt.Println("done", err)
-	}()
 
-	for vc != nil {
-		if queueindex != qi {
-			break
-		} else {
-			if pause {
-				continue
+		if volume != 1 {
+			if dec == nil {
+				dec, err = opus.NewDecoder(audioFrameRate, p.audio.Channels)
+				if err != nil {
+					break
+				}
 			}
 
-			buf := make([]int16, originalMaxBytes)
-
-			err := binary.Read(decoder, binary.LittleEndian, &buf)
+			pcm := make([]int16, maxFrameSize*p.audio.Channels)
+			num, err := dec.Decode(frame, pcm)
 			if err != nil {
-				// Okay! There's nothing left, time to quit.
-				fmt.Println("break")
 				break
 			}
 
-			for k := range buf {
-				buf[k] = int16(math.Floor(float64(buf[k]) * volume)) // Should work +/- values
+			pcm = pcm[:num*p.audio.Channels]
+			applyvolume(pcm, volume)
+
+			frame = make([]byte, maxFrameSize*p.audio.Channels)
+			num, err = p.encoder.Encode(pcm, frame)
+			if err != nil || num == 0 {
+				break
 			}
 
-			opus := make([]byte, originalMaxBytes)
+			frame = frame[:num]
 
-			num, err := opusEncoder.Encode(buf, opus)
-			if err == nil && num > 0 {
-				fmt.Println("sending")
-				vc.OpusSend <- opus[:num]
-			} else {
-				break
+			if rec != nil {
+				rec.err = errRecordVolume
 			}
 		}
+
+		if !p.sendframe(vc, frame) {
+			break
+		}
+
+		p.advance(frameduration)
+		p.checkprefetch()
+
+		if rec != nil {
+			rec.WriteFrame(frame)
+		}
+	}
+
+	return false
+}
+
+// opusFrameDuration returns how long an opus packet is, from its TOC byte.
+// It returns 0 if the packet is invalid. https://tools.ietf.org/html/rfc6716#section-3.1
+func opusFrameDuration(packet []byte) time.Duration {
+	if len(packet) < 1 {
+		return 0
+	}
+
+	toc := packet[0]
+	mode := toc >> 3
+
+	var size time.Duration
+	switch {
+	case mode < 12: // SILK: 10, 20, 40 or 60 ms
+		size = []time.Duration{10, 20, 40, 60}[mode%4] * time.Millisecond
+	case mode < 16: // Hybrid: 10 or 20 ms
+		size = []time.Duration{10, 20}[mode%2] * time.Millisecond
+	default: // CELT: 2.5, 5, 10 or 20 ms
+		size = []time.Duration{2500, 5000, 10000, 20000}[mode%4] * time.Microsecond
+	}
+
+	switch toc & 3 {
+	case 0:
+		return size
+	case 1, 2:
+		return size * 2
+	default:
+		if len(packet) < 2 {
+			return 0
+		}
+
+		return size * time.Duration(packet[1]&0x3F)
+	}
+}
+
+// DCA is a file format for storing opus frames, it's documented in
+// https://github.com/bwmarrin/dca/wiki/DCA1-specification
+// A DCA1 file starts with dcaMagic, followed by the length of the JSON metadata as an int32
+// and the metadata itself. After the header come the frames, each prefixed with its length as an int16.
+// Files without the magic are treated as DCA0, which is only the frames.
+const dcaMagic = "DCA1"
+
+// dcaMaxMetadata is the biggest metadata that is read, a broken file could otherwise make the reader allocate up to 2GB
+const dcaMaxMetadata = 1 << 20
+
+// dcaExtension is the file extension of DCA files in config.DcaPath
+const dcaExtension = ".dca"
+
+type dcaMetadata struct {
+	Dca    dcaInfo                `json:"dca"`
+	Opus   dcaOpus                `json:"opus"`
+	Info   *dcaSongInfo           `json:"info,omitempty"`
+	Origin *dcaOrigin             `json:"origin,omitempty"`
+	Extra  map[string]interface{} `json:"extra"`
+}
+
+type dcaInfo struct {
+	Version int     `json:"version"`
+	Tool    dcaTool `json:"tool"`
+}
+
+type dcaTool struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	URL     string `json:"url"`
+	Author  string `json:"author"`
+}
+
+type dcaOpus struct {
+	Mode       string `json:"mode"`
+	SampleRate int    `json:"sample_rate"`
+	FrameSize  int    `json:"frame_size"`
+	Abr        int    `json:"abr"`
+	Vbr        bool   `json:"vbr"`
+	Channels   int    `json:"channels"`
+}
+
+type dcaSongInfo struct {
+	Title  string `json:"title"`
+	Artist string `json:"artist"`
+	Album  string `json:"album"`
+	Genre  string `json:"genre"`
+	Cover  string `json:"cover"`
+}
+
+type dcaOrigin struct {
+	Source   string `json:"source"`
+	Abr      int    `json:"abr"`
+	Channels int    `json:"channels"`
+	Encoding string `json:"encoding"`
+	URL      string `json:"url"`
+}
+
+// newDCAMetadata returns the metadata for a song encoded with the settings of audio, audio.FrameSize
+// must be the size of the frames that are written since the frame duration of the file is read from it.
+func newDCAMetadata(track *videoInfo, audio AudioConfig) *dcaMetadata {
+	meta := &dcaMetadata{
+		Dca: dcaInfo{
+			Version: 1,
+			Tool: dcaTool{
+				Name:    "musicbot",
+				Version: "1.0.0",
+				URL:     "https://github.com/lemondevxyz/musicbot",
+				Author:  "lemondevxyz",
+			},
+		},
+		Opus: dcaOpus{
+			Mode:       audio.Application,
+			SampleRate: audioFrameRate,
+			FrameSize:  audio.FrameSize,
+			Abr:        audio.Bitrate * 1000,
+			Vbr:        true,
+			Channels:   audio.Channels,
+		},
+		Extra: map[string]interface{}{},
+	}
+
+	if track != nil && track.Base != nil {
+		meta.Info = &dcaSongInfo{
+			Title:  track.Base.Title,
+			Artist: track.Base.Author,
+		}
+
+		meta.Origin = &dcaOrigin{
+			Source:   "youtube",
+			Channels: audio.Channels,
+			URL:      "https://youtube.com/watch?v=" + track.Base.ID,
+		}
 	}
+
+	return meta
+}
+
+// errRecordVolume is used when a song cannot be recorded because the volume has been changed.
+var errRecordVolume = errors.New("dca: the volume was changed while recording")
+
+// dcaWriter writes opus frames in the DCA1 format
+type dcaWriter struct {
+	w io.Writer
+	// err is the first error that occurred, no more frames are written after it.
+	err error
+}
+
+// newDCAWriter writes the DCA header with meta to w, and returns a writer for the frames.
+func newDCAWriter(w io.Writer, meta *dcaMetadata) (*dcaWriter, error) {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.WriteString(w, dcaMagic)
+	if err != nil {
+		return nil, err
+	}
+
+	err = binary.Write(w, binary.LittleEndian, int32(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dcaWriter{w: w}, nil
+}
+
+// WriteFrame writes a single opus frame, prefixed by its length
+func (d *dcaWriter) WriteFrame(frame []byte) error {
+	if d.err != nil {
+		return d.err
+	}
+
+	if len(frame) > math.MaxInt16 {
+		d.err = errors.New("dca: frame is too big")
+		return d.err
+	}
+
+	d.err = binary.Write(d.w, binary.LittleEndian, int16(len(frame)))
+	if d.err != nil {
+		return d.err
+	}
+
+	_, d.err = d.w.Write(frame)
+	return d.err
+}
+
+// dcaReader reads opus frames from a DCA0 or DCA1 file
+type dcaReader struct {
+	r *bufio.Reader
+	// Metadata is nil for DCA0 files
+	Metadata *dcaMetadata
+}
+
+// newDCAReader reads the DCA header from r, if there is one.
+func newDCAReader(r io.Reader) (*dcaReader, error) {
+	rd := &dcaReader{r: bufio.NewReader(r)}
+
+	magic, err := rd.r.Peek(len(dcaMagic))
+	if err != nil {
+		return nil, err
+	}
+
+	if string(magic) != dcaMagic {
+		return rd, nil
+	}
+
+	rd.r.Discard(len(dcaMagic))
+
+	var size int32
+	err = binary.Read(rd.r, binary.LittleEndian, &size)
+	if err != nil {
+		return nil, err
+	}
+
+	if size < 0 || size > dcaMaxMetadata {
+		return nil, errors.New("dca: invalid metadata size")
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(rd.r, data)
+	if err != nil {
+		return nil, err
+	}
+
+	rd.Metadata = &dcaMetadata{}
+	err = json.Unmarshal(data, rd.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return rd, nil
+}
+
+// ReadFrame reads the next opus frame. It returns io.EOF when there are no frames left.
+func (d *dcaReader) ReadFrame() ([]byte, error) {
+	var size int16
+	err := binary.Read(d.r, binary.LittleEndian, &size)
+	if err != nil {
+		return nil, err
+	}
+
+	if size <= 0 {
+		return nil, errors.New("dca: invalid frame size")
+	}
+
+	frame := make([]byte, size)
+	_, err = io.ReadFull(d.r, frame)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return frame, err
 }
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestDCAMetadataSize(t *testing.T) {
+	for _, size := range []int32{-1, dcaMaxMetadata + 1, 1<<31 - 1} {
+		var buf bytes.Buffer
+		buf.WriteString(dcaMagic)
+		binary.Write(&buf, binary.LittleEndian, size)
+		buf.WriteString("{}")
+
+		_, err := newDCAReader(&buf)
+		if err == nil {
+			t.Errorf("read the metadata of size %d", size)
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(dcaMagic)
+	binary.Write(&buf, binary.LittleEndian, int32(2))
+	buf.WriteString("{}")
+
+	rd, err := newDCAReader(&buf)
+	if err != nil || rd.Metadata == nil {
+		t.Errorf("cannot read the metadata: %v", err)
+	}
+}
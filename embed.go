@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// embedColor is the color of every embed that the bot sends, it's youtube's red
+	embedColor = 0xff0000
+	// embedFields is how many fields discord allows in an embed
+	embedFields = 25
+	// embedDescription is how many characters discord allows in the description of an embed
+	embedDescription = 4096
+	// progressWidth is how many characters the progress bar of nowplaying is
+	progressWidth = 20
+)
+
+// canembed returns true if the bot is allowed to send embeds inside of a channel.
+// If the permissions cannot be found, the bot sends plain text to be safe.
+func canembed(s session, channelID string) bool {
+	perms, err := s.state().UserChannelPermissions(s.user().ID, channelID)
+	return err == nil && perms&discordgo.PermissionEmbedLinks != 0
+}
+
+// videourl returns the link of a song's youtube video, songs from DCA files and local files don't have one.
+func videourl(vid *videoInfo) string {
+	if len(vid.File) > 0 || islocal(vid.Base) {
+		return ""
+	}
+
+	return "https://www.youtube.com/watch?v=" + vid.Base.ID
+}
+
+// thumbnail returns the biggest thumbnail of a song, or nil if it has none.
+func thumbnail(vid *videoInfo) *discordgo.MessageEmbedThumbnail {
+	var url string
+	var width uint
+	for _, v := range vid.Base.Thumbnails {
+		if v.Width >= width {
+			url = v.URL
+			width = v.Width
+		}
+	}
+
+	if len(url) == 0 {
+		return nil
+	}
+
+	return &discordgo.MessageEmbedThumbnail{URL: url}
+}
+
+// playerfooter returns the footer of the player's embeds, it shows the loop, shuffle and volume of the player.
+func playerfooter(m *commandParameter) *discordgo.MessageEmbedFooter {
+	p := m.player
+
+	p.mu.Lock()
+	mode, shuffling, volume := p.loop, p.shuffle, p.volume
+	p.mu.Unlock()
+
+	loop := m.message("loopoff")
+	if mode == loopSong {
+		loop = m.message("loopsong")
+	} else if mode == loopQueue {
+		loop = m.message("loopqueue")
+	}
+
+	shuffle := m.message("shuffleoff")
+	if shuffling {
+		shuffle = m.message("shuffleon")
+	}
+
+	replaces := strings.NewReplacer(
+		"{{loop}}", loop,
+		"{{shuffle}}", shuffle,
+		"{{volume}}", fmt.Sprintf("%d", int(volume*100)))
+
+	return &discordgo.MessageEmbedFooter{Text: replaces.Replace(m.message("footer"))}
+}
+
+// queueembed returns an embed of the songs in the queue from start to end, the current song is highlighted.
+func queueembed(m *commandParameter, start, end int) *discordgo.MessageEmbed {
+	p := m.player
+
+	embed := &discordgo.MessageEmbed{
+		Title:  m.message("title"),
+		Color:  embedColor,
+		Footer: playerfooter(m),
+	}
+
+	p.mu.Lock()
+	queue, qi := p.queue, p.queueindex
+	p.mu.Unlock()
+
+	for i := start; i < end && i < len(queue); i++ {
+		v := queue[i]
+		if v == nil {
+			continue
+		}
+
+		format := m.message("embedloop")
+		if i == qi {
+			format = m.message("embedcurrent")
+			embed.Thumbnail = thumbnail(v)
+		}
+
+		str := replacestringwithtrackinfo(format, v)
+		str = strings.ReplaceAll(str, "{{index}}", fmt.Sprintf("%02d", i+1))
+
+		// The songs that don't fit are left out
+		if len(embed.Description)+len(str)+1 > embedDescription {
+			break
+		}
+
+		embed.Description += str + "\n"
+	}
+
+	return embed
+}
+
+// progressbar returns a bar that is filled as much as position is of duration.
+func progressbar(position, duration int64) string {
+	filled := 0
+	if duration > 0 {
+		filled = int(position * progressWidth / duration)
+	}
+
+	if filled > progressWidth {
+		filled = progressWidth
+	}
+
+	return strings.Repeat("▬", filled) + "🔘" + strings.Repeat("▬", progressWidth-filled)
+}
+
+func cmdNowPlaying(s session, m *commandParameter) {
+	p := m.player
+
+	p.mu.Lock()
+	queue, qi, playing, position := p.queue, p.queueindex, p.playingAudio, p.position
+	p.mu.Unlock()
+
+	if !playing || qi < 0 || qi >= len(queue) {
+		s.ChannelMessageSend(m.ChannelID, m.message("nothing"))
+		return
+	}
+
+	vid := queue[qi]
+
+	if !canembed(s, m.ChannelID) {
+		str := replacestringwithtrackinfo(m.message("text"), vid)
+		str = strings.ReplaceAll(str, "{{position}}", formatduration(position))
+
+		s.ChannelMessageSend(m.ChannelID, str)
+		return
+	}
+
+	embed := &discordgo.MessageEmbed{
+		Title:       vid.Base.Title,
+		URL:         videourl(vid),
+		Description: progressbar(int64(position), int64(vid.Base.Duration)),
+		Color:       embedColor,
+		Thumbnail:   thumbnail(vid),
+		Footer:      playerfooter(m),
+		Fields: []*discordgo.MessageEmbedField{
+			{
+				Name:   m.message("position"),
+				Value:  formatduration(position) + " / " + formatduration(vid.Base.Duration),
+				Inline: true,
+			},
+		},
+	}
+
+	if len(vid.Base.Author) > 0 {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:   m.message("author"),
+			Value:  vid.Base.Author,
+			Inline: true,
+		})
+	}
+
+	if vid.Requester != nil {
+		embed.Author = &discordgo.MessageEmbedAuthor{
+			Name:    replacestringwithtrackinfo(m.message("requester"), vid),
+			IconURL: vid.Requester.AvatarURL("64"),
+		}
+	}
+
+	s.ChannelMessageSendEmbed(m.ChannelID, embed)
+}
+
+// helpembeds returns embeds that explain every command, one field per command.
+func helpembeds(m *commandParameter) []*discordgo.MessageEmbed {
+	var embeds []*discordgo.MessageEmbed
+
+	var embed *discordgo.MessageEmbed
+	for _, v := range commands {
+		if embed == nil || len(embed.Fields) == embedFields {
+			embed = &discordgo.MessageEmbed{
+				Color: embedColor,
+			}
+
+			// Only the first embed has a title
+			if len(embeds) == 0 {
+				embed.Title = m.message("title")
+			}
+
+			embeds = append(embeds, embed)
+		}
+
+		replaces := strings.NewReplacer(
+			"{{name}}", strings.Title(v.alias[0]),
+			"{{alias}}", strings.Join(v.alias, ", "))
+
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:  replaces.Replace(m.message("embedcmd")),
+			Value: v.help,
+		})
+	}
+
+	return embeds
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The types of the events that the players send to the websocket clients
+const (
+	eventState          = "state"          // Sent once when a client connects, data is the player's state
+	eventTrackStarted   = "trackStarted"   // data is the song and the position it starts at
+	eventTrackEnded     = "trackEnded"     // data is the song and the position it stopped at
+	eventQueueChanged   = "queueChanged"   // data is the queue
+	eventPaused         = "paused"         // No data
+	eventResumed        = "resumed"        // No data
+	eventVolumeChanged  = "volumeChanged"  // data is the volume, from 0 to 100
+	eventLoopChanged    = "loopChanged"    // data is the loop mode
+	eventShuffleChanged = "shuffleChanged" // data is whether shuffle is on
+	eventVoiceJoined    = "voiceJoined"    // data is the voice channel, it's also sent when the bot is moved
+	eventVoiceLeft      = "voiceLeft"      // No data
+)
+
+const (
+	// eventBuffer is how many events a client can fall behind before it's disconnected
+	eventBuffer = 64
+	// eventPing is how often the clients are pinged, a client that doesn't answer within two pings is disconnected
+	eventPing = 30 * time.Second
+	// eventWriteTimeout is how long writing an event to a client can take
+	eventWriteTimeout = 10 * time.Second
+)
+
+// event is a change of a player's state, it's sent as json to the websocket clients of the guild.
+type event struct {
+	Type  string      `json:"type"`
+	Guild string      `json:"guild"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// eventClient is a websocket client that listens to the events of a guild.
+type eventClient struct {
+	events chan *event
+	// done is closed when the client is disconnected
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// drop disconnects the client.
+func (c *eventClient) drop() {
+	c.doneOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+var (
+	// eventClients holds the websocket clients, keyed by the player. Guilds have a player per bot.
+	eventClients   = map[*player]map[*eventClient]struct{}{}
+	eventClientsMu sync.RWMutex
+)
+
+// eventUpgrader upgrades the requests of /api/guilds/<id>/events. The requests that are authenticated with the api's token
+// are allowed from any origin, but the ones that use the dashboard's cookie must come from the dashboard.
+var eventUpgrader = websocket.Upgrader{
+	HandshakeTimeout: eventWriteTimeout,
+	CheckOrigin: func(r *http.Request) bool {
+		if requestsession(r) == nil {
+			return true
+		}
+
+		origin, err := url.Parse(r.Header.Get("Origin"))
+		return err == nil && strings.EqualFold(origin.Host, r.Host)
+	},
+}
+
+// subscribe returns a client that gets the events of a player.
+func subscribe(p *player) *eventClient {
+	c := &eventClient{
+		events: make(chan *event, eventBuffer),
+		done:   make(chan struct{}),
+	}
+
+	eventClientsMu.Lock()
+	if eventClients[p] == nil {
+		eventClients[p] = map[*eventClient]struct{}{}
+	}
+
+	eventClients[p][c] = struct{}{}
+	eventClientsMu.Unlock()
+
+	return c
+}
+
+// unsubscribe stops sending the events of a player to c.
+func unsubscribe(p *player, c *eventClient) {
+	eventClientsMu.Lock()
+	delete(eventClients[p], c)
+	if len(eventClients[p]) == 0 {
+		delete(eventClients, p)
+	}
+	eventClientsMu.Unlock()
+
+	c.drop()
+}
+
+// emit sends an event to the websocket clients of the player. It never blocks the player,
+// clients that fell behind by eventBuffer events are disconnected instead.
+func (p *player) emit(typ string, data interface{}) {
+	eventClientsMu.RLock()
+	defer eventClientsMu.RUnlock()
+
+	clients := eventClients[p]
+	if len(clients) == 0 {
+		return
+	}
+
+	ev := &event{
+		Type:  typ,
+		Guild: p.guildID,
+		Time:  time.Now(),
+		Data:  data,
+	}
+
+	for c := range clients {
+		select {
+		case c.events <- ev:
+		default:
+			c.drop()
+		}
+	}
+}
+
+// emitsong sends an event about a song of the queue, with the position that the song started or stopped at.
+func (p *player) emitsong(typ string, vid *videoInfo, index int, position time.Duration) {
+	p.emit(typ, map[string]interface{}{
+		"song":     newapisong(vid, index),
+		"position": position.Seconds(),
+	})
+}
+
+// emitqueue sends the queue to the websocket clients after it changed.
+func (p *player) emitqueue() {
+	p.emit(eventQueueChanged, newapiqueue(p))
+}
+
+// apiEvents streams the events of a player over a websocket, starting with the player's state.
+func apiEvents(w http.ResponseWriter, r *http.Request, p *player) {
+	conn, err := eventUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already replied with an error
+		return
+	}
+	defer conn.Close()
+
+	c := subscribe(p)
+	defer unsubscribe(p, c)
+
+	// The clients aren't expected to send anything, reading only notices when they leave or stop answering the pings
+	conn.SetReadLimit(512)
+	conn.SetReadDeadline(time.Now().Add(2 * eventPing))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * eventPing))
+	})
+
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				c.drop()
+				return
+			}
+		}
+	}()
+
+	write := func(ev *event) bool {
+		conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		err := conn.WriteJSON(ev)
+		if err != nil {
+			p.log().err(err).debugf("Cannot send an event to a websocket client")
+			return false
+		}
+
+		return true
+	}
+
+	if !write(&event{Type: eventState, Guild: p.guildID, Time: time.Now(), Data: newapistate(p)}) {
+		return
+	}
+
+	ticker := time.NewTicker(eventPing)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ev := <-c.events:
+			if !write(ev) {
+				return
+			}
+		case <-ticker.C:
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(eventWriteTimeout))
+			if err != nil {
+				return
+			}
+		case <-c.done:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(eventWriteTimeout))
+			return
+		}
+	}
+}
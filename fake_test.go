@@ -0,0 +1,343 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// The ids of the fake guild, discord's ids are numbers so that the arguments can parse them
+const (
+	testGuild      = "100"
+	testText       = "101"
+	testVoice      = "102"
+	testOtherVoice = "103"
+
+	testBot      = "200"
+	testListener = "201" // testListener is in testVoice
+	testUser     = "202" // testUser isn't in a voice channel
+	testOwner    = "203" // testOwner owns the guild, so it can manage it
+)
+
+// fakeMessage is a message that a fakeSession sent, embeds are recorded with their titles as the content
+type fakeMessage struct {
+	channelID string
+	content   string
+	embeds    []*discordgo.MessageEmbed
+}
+
+// fakeSession is a session that records what the commands send instead of talking to discord.
+// Its state holds the guild testGuild, with a text channel, two voice channels and the test users.
+type fakeSession struct {
+	st *discordgo.State
+
+	// nodm makes UserChannelCreate fail, and ratelimited makes UserUpdate fail
+	nodm        bool
+	ratelimited bool
+
+	mu     sync.Mutex
+	sent   []fakeMessage
+	avatar string
+	voice  *fakeVoice
+}
+
+func newfakesession(t *testing.T) *fakeSession {
+	st := discordgo.NewState()
+	st.User = &discordgo.User{ID: testBot, Username: "Bot", Bot: true}
+
+	member := func(u *discordgo.User) *discordgo.Member {
+		return &discordgo.Member{GuildID: testGuild, User: u}
+	}
+
+	err := st.GuildAdd(&discordgo.Guild{
+		ID:      testGuild,
+		Name:    "Guild",
+		OwnerID: testOwner,
+		// The role of everyone has the id of the guild
+		Roles: []*discordgo.Role{{ID: testGuild}},
+		Channels: []*discordgo.Channel{
+			{ID: testText, GuildID: testGuild, Type: discordgo.ChannelTypeGuildText},
+			{ID: testVoice, GuildID: testGuild, Type: discordgo.ChannelTypeGuildVoice, Bitrate: 64000},
+			{ID: testOtherVoice, GuildID: testGuild, Type: discordgo.ChannelTypeGuildVoice, Bitrate: 64000},
+		},
+		Members: []*discordgo.Member{
+			member(st.User),
+			member(&discordgo.User{ID: testListener, Username: "listener"}),
+			member(&discordgo.User{ID: testUser, Username: "user"}),
+			member(&discordgo.User{ID: testOwner, Username: "owner"}),
+		},
+		VoiceStates: []*discordgo.VoiceState{
+			{GuildID: testGuild, UserID: testListener, ChannelID: testVoice},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &fakeSession{st: st}
+}
+
+// allow gives everyone in the guild perms.
+func (f *fakeSession) allow(perms int64) {
+	guild, _ := f.st.Guild(testGuild)
+	guild.Roles[0].Permissions = perms
+}
+
+func (f *fakeSession) record(msg fakeMessage) *discordgo.Message {
+	f.mu.Lock()
+	f.sent = append(f.sent, msg)
+	f.mu.Unlock()
+
+	return &discordgo.Message{ChannelID: msg.channelID, Content: msg.content, Embeds: msg.embeds}
+}
+
+// messages returns what has been sent to a channel, in order.
+func (f *fakeSession) messages(channelID string) []fakeMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var list []fakeMessage
+	for _, msg := range f.sent {
+		if msg.channelID == channelID {
+			list = append(list, msg)
+		}
+	}
+
+	return list
+}
+
+// texts returns the contents of the messages of the text channel.
+func (f *fakeSession) texts() []string {
+	var list []string
+	for _, msg := range f.messages(testText) {
+		list = append(list, msg.content)
+	}
+
+	return list
+}
+
+func (f *fakeSession) ChannelMessageSend(channelID string, content string, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	return f.record(fakeMessage{channelID: channelID, content: content}), nil
+}
+
+func (f *fakeSession) ChannelMessageSendEmbed(channelID string, embed *discordgo.MessageEmbed, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	return f.ChannelMessageSendEmbeds(channelID, []*discordgo.MessageEmbed{embed}, options...)
+}
+
+func (f *fakeSession) ChannelMessageSendEmbeds(channelID string, embeds []*discordgo.MessageEmbed, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	return f.record(fakeMessage{channelID: channelID, content: embeds[0].Title, embeds: embeds}), nil
+}
+
+func (f *fakeSession) UserChannelCreate(recipientID string, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	if f.nodm {
+		return nil, errors.New("cannot send messages to this user")
+	}
+
+	return &discordgo.Channel{ID: "dm" + recipientID, Type: discordgo.ChannelTypeDM}, nil
+}
+
+func (f *fakeSession) UserChannelPermissions(userID, channelID string, options ...discordgo.RequestOption) (int64, error) {
+	return f.st.UserChannelPermissions(userID, channelID)
+}
+
+func (f *fakeSession) UserUpdate(username, avatar string, options ...discordgo.RequestOption) (*discordgo.User, error) {
+	if f.ratelimited {
+		return nil, errors.New("you are being rate limited")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(username) > 0 {
+		f.st.User.Username = username
+	}
+
+	if len(avatar) > 0 {
+		f.avatar = avatar
+	}
+
+	return f.st.User, nil
+}
+
+func (f *fakeSession) state() guildState {
+	return f.st
+}
+
+func (f *fakeSession) user() *discordgo.User {
+	return f.st.User
+}
+
+func (f *fakeSession) joinvoice(guildID, channelID string) (voiceConnection, error) {
+	v := newfakevoice(channelID)
+
+	f.mu.Lock()
+	f.voice = v
+	f.mu.Unlock()
+
+	return v, nil
+}
+
+// fakeVoice is a voice connection that counts the frames that it gets.
+type fakeVoice struct {
+	send chan []byte
+
+	mu           sync.Mutex
+	channelID    string
+	frames       int
+	speaking     bool
+	disconnected bool
+}
+
+func newfakevoice(channelID string) *fakeVoice {
+	v := &fakeVoice{send: make(chan []byte, 2), channelID: channelID}
+	go v.receive()
+	return v
+}
+
+func (v *fakeVoice) receive() {
+	for range v.send {
+		v.mu.Lock()
+		v.frames++
+		v.mu.Unlock()
+	}
+}
+
+// status returns the channel, how many frames have been received and if it's disconnected.
+func (v *fakeVoice) status() (string, int, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.channelID, v.frames, v.disconnected
+}
+
+func (v *fakeVoice) ChangeChannel(channelID string, mute, deaf bool) error {
+	v.mu.Lock()
+	v.channelID = channelID
+	v.mu.Unlock()
+	return nil
+}
+
+func (v *fakeVoice) Speaking(speaking bool) error {
+	v.mu.Lock()
+	v.speaking = speaking
+	v.mu.Unlock()
+	return nil
+}
+
+func (v *fakeVoice) Disconnect() error {
+	v.mu.Lock()
+	v.disconnected = true
+	v.mu.Unlock()
+	return nil
+}
+
+func (v *fakeVoice) Close() {}
+
+func (v *fakeVoice) ready() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return !v.disconnected
+}
+
+func (v *fakeVoice) opus() chan []byte {
+	return v.send
+}
+
+// newtestbot sets up the config and the globals for a test, and returns a bot with the player of testGuild.
+func newtestbot(t *testing.T) (*bot, *player) {
+	dir := t.TempDir()
+
+	setconfig(&Config{
+		Prefix:       "!",
+		Language:     "en",
+		LogLevel:     "error",
+		DcaPath:      dir,
+		MessagesPath: dir + "/messages.json",
+		AliasesPath:  dir + "/aliases.json",
+		Audio: AudioConfig{
+			Bitrate:     64,
+			FrameSize:   960,
+			Channels:    2,
+			Application: "audio",
+			BufferSize:  512 * 1024,
+		},
+	}, map[string]catalog{})
+	setuplogging()
+
+	guildMessages = map[string]messageOverrides{}
+	guildAliases = map[string]map[string]string{}
+
+	b := &bot{concurrency: 1, players: map[string]*player{}}
+	bots = []*bot{b}
+
+	p, err := b.getplayer(testGuild)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The players of the test, and the ones that the console created, don't keep running in the next tests
+	t.Cleanup(func() {
+		for _, p := range allplayers() {
+			p.close()
+		}
+	})
+
+	return b, p
+}
+
+// editconfig replaces the config with a copy of it that f changed.
+func editconfig(f func(c *Config)) {
+	c := *getconfig()
+	f(&c)
+	setconfig(&c, getcatalogs())
+}
+
+// locked runs f with the lock of p, so that the tests can look at the player's state while it runs.
+func locked(p *player, f func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	f()
+}
+
+// newmessage returns a message of the text channel of testGuild.
+func newmessage(authorID, content string) *discordgo.MessageCreate {
+	return &discordgo.MessageCreate{Message: &discordgo.Message{
+		ID:        content,
+		GuildID:   testGuild,
+		ChannelID: testText,
+		Content:   content,
+		Author:    &discordgo.User{ID: authorID, Username: "user" + authorID, Discriminator: "0001"},
+	}}
+}
+
+// commandsrun returns how many commands have been counted, no matter their outcome.
+func commandsrun() float64 {
+	metricCommands.mu.Lock()
+	defer metricCommands.mu.Unlock()
+
+	total := 0.0
+	for _, v := range metricCommands.values {
+		total += v
+	}
+
+	return total
+}
+
+// waitfor fails the test if cond isn't true within a few seconds.
+func waitfor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -6,7 +6,8 @@ require (
 	github.com/bwmarrin/discordgo v0.27.0
 	github.com/dlclark/regexp2 v1.8.0 // indirect
 	github.com/dop251/goja v0.0.0-20230216180835-5937a312edda // indirect
-	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/fsnotify/fsnotify v1.6.0
+	github.com/gorilla/websocket v1.5.0
 	github.com/kkdai/youtube/v2 v2.7.18
 	github.com/mitchellh/go-testing-interface v1.0.0 // indirect
 	github.com/spf13/viper v1.15.0
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// defaultLanguage is the language of the messages inside of the commands, every other language falls back to it.
+const defaultLanguage = "en"
+
+// catalog holds the messages of a language, keyed by the command's name and then by the message's key.
+// The name of a command is its first alias.
+type catalog map[string]map[string]string
+
+// loadcatalogs loads every <language>.json file inside of dir, and checks that they hold every message of every command.
+func loadcatalogs(dir string) (map[string]catalog, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	cats := map[string]catalog{}
+
+	for _, file := range files {
+		body, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		var c catalog
+		err = json.Unmarshal(body, &c)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+
+		err = c.validate()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+
+		cats[strings.TrimSuffix(filepath.Base(file), ".json")] = c
+	}
+
+	return cats, nil
+}
+
+// validate returns an error if the catalog misses a message that a command uses, or has a message that no command uses.
+func (c catalog) validate() error {
+	if missing := c.missing(); len(missing) > 0 {
+		return fmt.Errorf("missing messages: %s", strings.Join(missing, ", "))
+	}
+
+	known := map[string]bool{}
+	for _, cmd := range commands {
+		for key := range cmd.messages {
+			known[cmd.alias[0]+"."+key] = true
+		}
+	}
+
+	var unknown []string
+	for name, messages := range c {
+		for key := range messages {
+			if !known[name+"."+key] {
+				unknown = append(unknown, name+"."+key)
+			}
+		}
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown messages: %s", strings.Join(unknown, ", "))
+	}
+
+	return messageOverrides(c).validate()
+}
+
+// missing returns the messages of the commands that the catalog doesn't have, as <command>.<key>.
+func (c catalog) missing() []string {
+	var missing []string
+	for _, cmd := range commands {
+		name := cmd.alias[0]
+		for key := range cmd.messages {
+			if _, ok := c[name][key]; !ok {
+				missing = append(missing, name+"."+key)
+			}
+		}
+	}
+
+	sort.Strings(missing)
+	return missing
+}
+
+// checklanguages returns an error if the config or a guild uses a language that has no catalog in cats.
+func (c Config) checklanguages(cats map[string]catalog) error {
+	languages := map[string]string{"language": c.Language}
+	for id, guild := range c.Guilds {
+		languages["guilds."+id+".language"] = guild.Language
+	}
+
+	for key, lang := range languages {
+		if _, ok := cats[lang]; lang != "" && lang != defaultLanguage && !ok {
+			return fmt.Errorf("%s: there is no catalog for %q", key, lang)
+		}
+	}
+
+	return nil
+}
+
+// message returns the message of cmd for a guild. The messages that the guild set with setmessage come first,
+// then the ones of the config, then the guild's catalog, and last the default language.
+func message(guildID string, cmd *command, key string) string {
+	name := cmd.alias[0]
+
+	guildMessagesMu.RLock()
+	str, ok := guildMessages[guildID][name][key]
+	guildMessagesMu.RUnlock()
+	if ok {
+		return str
+	}
+
+	conf := getconfig()
+	if str, ok := conf.Guilds[guildID].Messages[name][key]; ok {
+		return str
+	}
+
+	if str, ok := conf.Messages[name][key]; ok {
+		return str
+	}
+
+	if c, ok := getcatalogs()[conf.language(guildID)]; ok {
+		if str, ok := c[name][key]; ok {
+			return str
+		}
+	}
+
+	return cmd.messages[key]
+}
+
+// message returns the message of the command in the language of the guild that the command was used in.
+func (m *commandParameter) message(key string) string {
+	return message(m.GuildID, m.cmd, key)
+}
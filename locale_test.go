@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadCatalogs(t *testing.T) {
+	newtestbot(t)
+
+	// The catalog that is shipped must always have every message
+	cats, err := loadcatalogs("locales")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	es, ok := cats["es"]
+	if !ok {
+		t.Fatal("es.json wasn't loaded")
+	}
+
+	tests := []struct {
+		name   string
+		change func(c catalog)
+		err    string
+	}{
+		{"missing message", func(c catalog) { delete(c["play"], "empty") }, "missing messages: play.empty"},
+		{"unknown message", func(c catalog) { c["play"]["nope"] = "?" }, "unknown messages: play.nope"},
+		{"unknown command", func(c catalog) { c["nope"] = map[string]string{"empty": "?"} }, "unknown messages: nope.empty"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := catalog{}
+			for name, messages := range es {
+				c[name] = map[string]string{}
+				for key, str := range messages {
+					c[name][key] = str
+				}
+			}
+			tt.change(c)
+
+			body, err := json.Marshal(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dir := t.TempDir()
+			err = ioutil.WriteFile(filepath.Join(dir, "es.json"), body, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = loadcatalogs(dir)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMessageFallback(t *testing.T) {
+	newtestbot(t)
+	editconfig(func(c *Config) { c.Language = "es" })
+	setconfig(getconfig(), map[string]catalog{"es": {"play": {"empty": "No se encontraron videos"}}})
+
+	play := findcommand("play")
+	if str := message(testGuild, play, "empty"); str != "No se encontraron videos" {
+		t.Errorf("got %q, want the message of the catalog", str)
+	}
+
+	// The catalog misses it, so it's in the default language
+	if str := message(testGuild, play, "param"); str != play.messages["param"] {
+		t.Errorf("got %q, want %q", str, play.messages["param"])
+	}
+}
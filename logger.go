@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// logLevel is how important a log entry is, the entries below config.LogLevel are dropped.
+type logLevel int
+
+const (
+	levelTrace logLevel = iota // Every frame that is sent, only meant for debugging the audio
+	levelDebug                 // What the players and ffmpeg are doing
+	levelInfo                  // What the bot is doing, i.e joining and leaving voice channels
+	levelWarn                  // Something failed, but the bot carries on
+	levelError                 // Something failed, and a song or a command couldn't be finished
+	levelFatal                 // The bot cannot start
+)
+
+// logLevels maps the values of config.LogLevel to the levels
+var logLevels = map[string]logLevel{
+	"trace": levelTrace,
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+func (l logLevel) String() string {
+	switch l {
+	case levelTrace:
+		return "TRACE"
+	case levelDebug:
+		return "DEBUG"
+	case levelInfo:
+		return "INFO"
+	case levelWarn:
+		return "WARN"
+	case levelError:
+		return "ERROR"
+	}
+
+	return "FATAL"
+}
+
+// logSettings holds the level and format of the logs. They are set from the config, before that
+// everything from info is logged as text.
+type logSettings struct {
+	level logLevel
+	json  bool
+}
+
+var (
+	// logCurrent holds the current logSettings, it's read for every entry so it can change while the bot runs
+	logCurrent atomic.Value
+	// logOutput is where the entries are written, logMu keeps entries from being written into each other
+	logOutput io.Writer = os.Stderr
+	logMu     sync.Mutex
+)
+
+func init() {
+	logCurrent.Store(logSettings{level: levelInfo})
+}
+
+// setuplogging applies config.LogLevel and config.LogFormat, and routes discordgo's logs through the logger.
+func setuplogging() {
+	c := getconfig()
+	logCurrent.Store(logSettings{
+		level: logLevels[c.LogLevel],
+		json:  c.LogFormat == "json",
+	})
+
+	discordgo.Logger = func(msgL, caller int, format string, a ...interface{}) {
+		level := levelDebug
+		switch msgL {
+		case discordgo.LogError:
+			level = levelError
+		case discordgo.LogWarning:
+			level = levelWarn
+		case discordgo.LogInformational:
+			level = levelInfo
+		}
+
+		logs.with("source", "discordgo").write(level, format, a...)
+	}
+}
+
+// logField is a key and value that is added to every entry of a logger.
+type logField struct {
+	key   string
+	value interface{}
+}
+
+// logger writes log entries with fields. Loggers are never changed, with returns a new logger instead,
+// so they can be shared between goroutines.
+type logger struct {
+	fields []logField
+}
+
+// logs is the logger without fields, every other logger is made from it.
+var logs = &logger{}
+
+// with returns a logger that adds a field to every entry, i.e guild, track or command.
+func (l *logger) with(key string, value interface{}) *logger {
+	fields := make([]logField, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+
+	return &logger{fields: append(fields, logField{key, value})}
+}
+
+// err returns a logger that adds err to every entry.
+func (l *logger) err(err error) *logger {
+	return l.with("error", err)
+}
+
+// enabled returns true if the entries of level are logged, so that expensive entries can be skipped.
+func (l *logger) enabled(level logLevel) bool {
+	settings := logCurrent.Load().(logSettings)
+	return level >= settings.level
+}
+
+func (l *logger) tracef(format string, a ...interface{}) { l.write(levelTrace, format, a...) }
+func (l *logger) debugf(format string, a ...interface{}) { l.write(levelDebug, format, a...) }
+func (l *logger) infof(format string, a ...interface{})  { l.write(levelInfo, format, a...) }
+func (l *logger) warnf(format string, a ...interface{})  { l.write(levelWarn, format, a...) }
+func (l *logger) errorf(format string, a ...interface{}) { l.write(levelError, format, a...) }
+
+// fatalf logs an entry and exits, it's only used while the bot starts.
+func (l *logger) fatalf(format string, a ...interface{}) {
+	l.write(levelFatal, format, a...)
+	os.Exit(1)
+}
+
+// write formats an entry as text or json and writes it to logOutput.
+func (l *logger) write(level logLevel, format string, a ...interface{}) {
+	settings := logCurrent.Load().(logSettings)
+	if level < settings.level {
+		return
+	}
+
+	now := time.Now()
+	msg := fmt.Sprintf(format, a...)
+
+	var line []byte
+	if settings.json {
+		entry := map[string]interface{}{}
+		for _, f := range l.fields {
+			entry[f.key] = logvalue(f.value)
+		}
+
+		entry["time"] = now.Format(time.RFC3339Nano)
+		entry["level"] = strings.ToLower(level.String())
+		entry["msg"] = msg
+
+		var err error
+		line, err = json.Marshal(entry)
+		if err != nil {
+			line = []byte(strconv.Quote(msg))
+		}
+	} else {
+		var b strings.Builder
+		b.WriteString(now.Format("2006-01-02T15:04:05.000Z07:00"))
+		b.WriteString(" ")
+		b.WriteString(fmt.Sprintf("%-5s", level))
+		b.WriteString(" ")
+		b.WriteString(msg)
+
+		for _, f := range l.fields {
+			b.WriteString(" ")
+			b.WriteString(f.key)
+			b.WriteString("=")
+			b.WriteString(logtext(logvalue(f.value)))
+		}
+
+		line = []byte(b.String())
+	}
+
+	logMu.Lock()
+	logOutput.Write(append(line, '\n'))
+	logMu.Unlock()
+}
+
+// logvalue converts the values that json doesn't format well, like errors and durations, into strings.
+func logvalue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	return v
+}
+
+// logtext formats a value of a field as text, values with spaces or quotes are quoted.
+func logtext(v interface{}) string {
+	str := fmt.Sprint(v)
+	if str == "" || strings.ContainsAny(str, " \t\n\"=") {
+		return strconv.Quote(str)
+	}
+
+	return str
+}
+
+// log returns the logger of a player, its entries have the guild's id, and the bot's id when there are several bots.
+func (p *player) log() *logger {
+	if len(bots) > 1 {
+		return logs.with("bot", p.bot.id).with("guild", p.guildID)
+	}
+
+	return logs.with("guild", p.guildID)
+}
+
+// log returns the logger of a track, its entries have the guild's id and the song's id or file.
+func (t *track) log() *logger {
+	return t.p.log().with("track", trackid(t.vid))
+}
+
+// trackid returns the id of a song's youtube video, or the name of its DCA file.
+func trackid(vid *videoInfo) string {
+	if len(vid.File) > 0 {
+		return vid.File
+	}
+
+	return vid.Base.ID
+}
+
+// log returns the logger of a command, its entries have the guild, the command and the user that used it.
+func (m *commandParameter) log() *logger {
+	return logs.with("guild", m.GuildID).with("command", m.cmd.alias[0]).with("user", m.Author.ID)
+}
@@ -1,34 +1,37 @@
 package main
 
 import (
-	"bufio"
 	"encoding/base64"
+	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"math"
 	"net/http"
 	"net/url"
 	"os"
-	"os/signal"
-	"strconv"
+	"path/filepath"
+	"runtime/debug"
 	"strings"
-	"syscall"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/bwmarrin/discordgo"
 	ytdl "github.com/kkdai/youtube/v2"
 	"github.com/spf13/viper"
 	"google.golang.org/api/googleapi/transport"
 	"google.golang.org/api/youtube/v3"
-	"gopkg.in/hraban/opus.v2"
 )
 
-type commandCallback func(s *discordgo.Session, m *commandParameter)
+type commandCallback func(s session, m *commandParameter)
 type commandParameter struct {
 	*discordgo.MessageCreate
-	cmd   *command
-	Split []string
+	cmd *command
+	// player is the player of the guild that the message was sent in
+	player *player
+	// args holds the arguments of the command, parsed by cmd.args
+	args arguments
 }
 
 //
@@ -36,17 +39,23 @@ type commandParameter struct {
 type videoInfo struct {
 	Base *ytdl.Video
 	Name string
+	// Requester is the user that added the song to the queue
+	Requester *discordgo.User
+	// File is the path of a pre-encoded DCA file, songs with a file are played without ffmpeg.
+	File string
 }
 
 type command struct {
 	alias    []string
 	help     string
 	messages map[string]string
+	// placeholders holds the placeholders that each message can use, without the braces
+	placeholders map[string][]string
+	// args are the arguments that the command takes, the message is checked against them before callback runs
+	args     []argSpec
 	callback commandCallback
 }
 
-var sesh *discordgo.Session
-
 var commands []*command
 var ytcl = ytdl.Client{
 	Debug: false,
@@ -62,21 +71,99 @@ func init() {
 				"empty":   "No videos found",
 				"param":   "Please provide a serach query, or a link to a youtube video",
 			},
+			placeholders: map[string][]string{
+				"success": trackPlaceholders,
+			},
+			args: []argSpec{
+				{name: "query", kind: argRest, optional: true},
+			},
 			callback: cmdPlay,
 		},
 
 		&command{
-			alias: []string{"queue", "q", "playlist"},
-			help:  "Sends a message containing the songs in the current",
+			alias: []string{"playdca", "pd"},
+			help:  "Adds a pre-encoded DCA file to the queue",
+			messages: map[string]string{
+				"success":  "Added **{{title}}** to the queue!",
+				"notfound": "There is no DCA file called **{{file}}**",
+				"param":    "Please provide the name of a DCA file",
+			},
+			placeholders: map[string][]string{
+				"success":  trackPlaceholders,
+				"notfound": {"file"},
+			},
+			args: []argSpec{
+				{name: "file", kind: argString},
+			},
+			callback: cmdPlayDCA,
+		},
+
+		&command{
+			alias: []string{"dcafiles", "df"},
+			help:  "Sends a message containing the available DCA files",
 			messages: map[string]string{
 				"start": "```",
-				"loop":  "{{index}}. {{title}} | {{name}}",
+				"loop":  "{{file}}",
 				"end":   "```",
-				"empty": "The queue is empty",
+				"empty": "There are no DCA files",
+			},
+			placeholders: map[string][]string{
+				"loop": {"file"},
+			},
+			callback: cmdDCAFiles,
+		},
+
+		&command{
+			alias: []string{"queue", "q", "playlist"},
+			help:  "Sends a message containing the songs in the current",
+			messages: map[string]string{
+				"start":        "```",
+				"loop":         "{{index}}. {{title}} | {{name}}",
+				"end":          "```",
+				"empty":        "The queue is empty",
+				"title":        "Queue",
+				"embedloop":    "`{{index}}.` {{link}} `{{duration}}` | {{name}}",
+				"embedcurrent": "**`{{index}}.` {{link}} `{{duration}}` | {{name}}**",
+				"footer":       "Loop: {{loop}} | Shuffle: {{shuffle}} | Volume: {{volume}}%",
+				"loopoff":      "off",
+				"loopsong":     "current song",
+				"loopqueue":    "current queue",
+				"shuffleon":    "on",
+				"shuffleoff":   "off",
+			},
+			placeholders: map[string][]string{
+				"loop":         append([]string{"index"}, trackPlaceholders...),
+				"embedloop":    append([]string{"index"}, trackPlaceholders...),
+				"embedcurrent": append([]string{"index"}, trackPlaceholders...),
+				"footer":       {"loop", "shuffle", "volume"},
 			},
 			callback: cmdQueue,
 		},
 
+		&command{
+			alias: []string{"nowplaying", "np"},
+			help:  "Sends a message containing the current song and how much of it has been played",
+			messages: map[string]string{
+				"nothing":    "Nothing is playing",
+				"text":       "Now playing **{{title}}** `{{position}}/{{duration}}` | {{name}}",
+				"position":   "Position",
+				"author":     "Channel",
+				"requester":  "Requested by {{name}}",
+				"footer":     "Loop: {{loop}} | Shuffle: {{shuffle}} | Volume: {{volume}}%",
+				"loopoff":    "off",
+				"loopsong":   "current song",
+				"loopqueue":  "current queue",
+				"shuffleon":  "on",
+				"shuffleoff": "off",
+			},
+			placeholders: map[string][]string{
+				"text":      append([]string{"position"}, trackPlaceholders...),
+				"requester": trackPlaceholders,
+				"footer":    {"loop", "shuffle", "volume"},
+			},
+			callback: cmdNowPlaying,
+		},
+
 		&command{
 			alias: []string{"skip", "sk"},
 			help:  "Skips the current song and plays the next song if there is one",
@@ -94,6 +181,9 @@ func init() {
 				"song":  "Current loop is set to **current song**",
 				"queue": "Current loop is set to **current queue**",
 			},
+			args: []argSpec{
+				{name: "mode", kind: argString, optional: true, choices: []string{"off", "song", "queue", "playlist"}},
+			},
 			callback: cmdLoop,
 		},
 
@@ -101,19 +191,40 @@ func init() {
 			alias: []string{"join", "j"},
 			help:  "Joins the current voice channel",
 			messages: map[string]string{
-				"already_in": "I am already in a voice channel",
+				"already_in": "I am already in a voice channel, use summon to move me to yours",
 				"no_channel": "You need to be in a voice channel",
 				"success":    "Successfully joined your voice channel",
 			},
 			callback: cmdJoin,
 		},
 
+		&command{
+			alias: []string{"summon", "move", "mv"},
+			help:  "Moves the bot to your voice channel, or to the given one, the queue keeps playing",
+			messages: map[string]string{
+				"already_in": "I am already in that voice channel",
+				"no_channel": "You need to be in a voice channel",
+				"not_voice":  "That is not a voice channel of this server",
+				"success":    "Successfully moved to the voice channel",
+			},
+			args: []argSpec{
+				{name: "channel", kind: argChannel, optional: true},
+			},
+			callback: cmdSummon,
+		},
+
 		&command{
 			alias: []string{"volume", "vol", "v"},
 			help:  "Displays or sets the volume, acceptable values are from 0 to 100",
 			messages: map[string]string{
 				"volume": "Volume is set to **{{volume}}**",
 			},
+			placeholders: map[string][]string{
+				"volume": {"volume"},
+			},
+			args: []argSpec{
+				{name: "volume", kind: argInt, optional: true, min: 0, max: 100},
+			},
 			callback: cmdVolume,
 		},
 
@@ -143,6 +254,12 @@ func init() {
 				"ratelimit": "You're changing the avatar too fast, Try again later.",
 				"param":     "Please provide a name for me to change",
 			},
+			placeholders: map[string][]string{
+				"setname": {"old", "new"},
+			},
+			args: []argSpec{
+				{name: "name", kind: argRest},
+			},
 			callback: cmdSetName,
 		},
 
@@ -151,8 +268,12 @@ func init() {
 			help:  "Sets the bot's avatar",
 			messages: map[string]string{
 				"setavatar": "Successfully changed the bot's profile picture",
+				"error":     "Cannot change the profile picture, try again later or with another image",
 				"param":     "Please provide an image as attachment, or a url of an image",
 			},
+			args: []argSpec{
+				{name: "url", kind: argURL, optional: true},
+			},
 			callback: cmdSetAvatar,
 		},
 
@@ -166,6 +287,39 @@ func init() {
 			callback: cmdShuffle,
 		},
 
+		&command{
+			alias: []string{"seek", "se"},
+			help:  "Plays the current song from a position, like 90, 1:30 or 1m30s",
+			messages: map[string]string{
+				"success": "Playing from **{{position}}**",
+				"nothing": "Nothing is playing",
+				"toolong": "The song is shorter than that",
+			},
+			placeholders: map[string][]string{
+				"success": {"position"},
+			},
+			args: []argSpec{
+				{name: "position", kind: argDuration},
+			},
+			callback: cmdSeek,
+		},
+
+		&command{
+			alias: []string{"remove", "rm"},
+			help:  "Removes a song from the queue, by its number in the queue",
+			messages: map[string]string{
+				"success":  "Removed **{{title}}** from the queue",
+				"notfound": "There is no song with that number",
+			},
+			placeholders: map[string][]string{
+				"success": trackPlaceholders,
+			},
+			args: []argSpec{
+				{name: "number", kind: argInt, min: 1, max: math.MaxInt32},
+			},
+			callback: cmdRemove,
+		},
+
 		&command{
 			alias: []string{"help", "h"},
 			help:  "Send a message explaining every command",
@@ -177,6 +331,14 @@ func init() {
 				"end":        "",
 				"success":    "Check your dms",
 				"error":      "I cannot DM you",
+				"title":      "Commands",
+				"embedcmd":   "{{name}} ({{alias}})",
+				"unknown":    "There is no command called **{{command}}**, did you mean **{{suggestion}}**?",
+			},
+			placeholders: map[string][]string{
+				"cmd":      {"name", "alias", "help"},
+				"embedcmd": {"name", "alias"},
+				"unknown":  {"command", "suggestion"},
 			},
 			callback: cmdHelp,
 		},
@@ -193,24 +355,93 @@ func init() {
 		},
 
 		&command{
-			alias: []string{"leave", "l"},
+			alias: []string{"setmessage", "sm"},
+			help:  "Changes a message of a command in this server, or resets it when no message is given",
+			messages: map[string]string{
+				"start":      "```",
+				"loop":       "{{key}} {{placeholders}}",
+				"end":        "```",
+				"success":    "Changed the message **{{key}}** of **{{command}}**",
+				"reset":      "Reset the message **{{key}}** of **{{command}}**",
+				"invalid":    "The message cannot be changed: {{error}}",
+				"nocommand":  "There is no command called **{{command}}**",
+				"permission": "You need the Manage Server permission to change messages",
+				"param":      "Please provide a command, a message and what it should say",
+			},
+			placeholders: map[string][]string{
+				"loop":      {"key", "placeholders"},
+				"success":   {"command", "key"},
+				"reset":     {"command", "key"},
+				"invalid":   {"error"},
+				"nocommand": {"command"},
+			},
+			args: []argSpec{
+				{name: "command", kind: argString},
+				{name: "key", kind: argString, optional: true},
+				{name: "message", kind: argRest, optional: true},
+			},
+			callback: cmdSetMessage,
+		},
+
+		&command{
+			alias: []string{"playsample", "ps"},
+			help:  "Adds a few sample songs to the queue, to test the play command",
+			messages: map[string]string{
+				"success": "Added **{{title}}** to the queue!",
+				"empty":   "No videos found",
+			},
+			placeholders: map[string][]string{
+				"success": trackPlaceholders,
+			},
+			callback: cmdPlaySample,
+		},
+
+		&command{
+			alias: []string{"alias", "al"},
+			help:  "Lists the aliases of this server, adds an alias to a command, or removes an alias when no command is given",
+			messages: map[string]string{
+				"start":      "```",
+				"loop":       "{{alias}} -> {{command}}",
+				"end":        "```",
+				"empty":      "This server has no aliases",
+				"success":    "**{{alias}}** is now an alias of **{{command}}**",
+				"removed":    "Removed the alias **{{alias}}**",
+				"notfound":   "There is no alias called **{{alias}}**",
+				"taken":      "**{{alias}}** is already an alias of **{{command}}**",
+				"nocommand":  "There is no command called **{{command}}**",
+				"permission": "You need the Manage Server permission to change aliases",
+			},
+			placeholders: map[string][]string{
+				"loop":      {"alias", "command"},
+				"success":   {"alias", "command"},
+				"removed":   {"alias"},
+				"notfound":  {"alias"},
+				"taken":     {"alias", "command"},
+				"nocommand": {"command"},
+			},
+			args: []argSpec{
+				{name: "alias", kind: argString, optional: true},
+				{name: "command", kind: argString, optional: true},
+			},
+			callback: cmdAlias,
+		},
+
+		&command{
+			alias: []string{"leave", "lv"},
 			help:  "Leaves the voice channel",
 			messages: map[string]string{
 				"novoice": "The bot is not currently inside a voice channel",
+				// shutdown is sent by every player that is in a voice channel when the bot shuts down
+				"shutdown": "The bot is shutting down, see you soon",
 			},
 			callback: cmdLeave,
 		},
 	}
+
+	addusage(commands)
 }
 
 var yt *youtube.Service
-var vc *discordgo.VoiceConnection
-
-var queue = []*videoInfo{}
-var queueindex = -1 // This is the original queue index
-
-var loop = loopOff
-var shuffle = false
 
 var sample = []string{
 	"https://www.youtube.com/watch?v=eCGV26aj-mM",
@@ -220,15 +451,13 @@ var sample = []string{
 	"https://www.youtube.com/watch?v=xk9EuEwMKcM",
 }
 
-const (
-	loopOff   = iota // No cmdLoop(
-	loopSong         // cmdLoop( current song
-	loopQueue        // cmdLoop( current queue
-)
-
-var pause = false
-
 func main() {
+	flag.Parse()
+
+	err := registercommands(commands)
+	if err != nil {
+		logs.err(err).fatalf("Cannot register the commands")
+	}
 
 	viper.SetConfigName("config")
 	viper.AddConfigPath(".")
@@ -236,248 +465,434 @@ func main() {
 	viper.SetDefault("youtubeKey", "")
 	viper.SetDefault("prefix", "")
 	viper.SetDefault("status", "")
-
-	var err error
+	viper.SetDefault("dcaPath", "dca")
+	viper.SetDefault("dcaRecord", false)
+	viper.SetDefault("prefetchSeconds", 10)
+	viper.SetDefault("opusPassthrough", true)
+	viper.SetDefault("idleTimeout", 300)
+	viper.SetDefault("aloneTimeout", 60)
+	viper.SetDefault("reconnectAttempts", 5)
+	viper.SetDefault("language", defaultLanguage)
+	viper.SetDefault("localesPath", "locales")
+	viper.SetDefault("messagesPath", "messages.json")
+	viper.SetDefault("aliasesPath", "aliases.json")
+	viper.SetDefault("shards", 1)
+	viper.SetDefault("shutdownTimeout", 15)
+	viper.SetDefault("logLevel", "info")
+	viper.SetDefault("logFormat", "text")
+	viper.SetDefault("audio.bitrate", 64)
+	viper.SetDefault("audio.frameSize", 960)
+	viper.SetDefault("audio.channels", 2)
+	viper.SetDefault("audio.application", "audio")
+	viper.SetDefault("audio.bufferSize", 1024*512)
+	viper.SetDefault("audio.maxBitrate", 384)
 
 	// Initiate viper for our config
 	err = viper.ReadInConfig()
-	if err != nil {
-		log.Fatalf("Cannot read config, error: %v", err)
+	// The console doesn't need a token, so it runs with the defaults when there is no config file
+	var notfound viper.ConfigFileNotFoundError
+	if err != nil && !(*consoleFlag && errors.As(err, &notfound)) {
+		logs.err(err).fatalf("Cannot read config")
 	}
 
 	// Unmarshal the config
-	err = viper.Unmarshal(&config)
+	c := &Config{}
+	err = viper.Unmarshal(c)
 	if err != nil {
-		log.Fatalf("Unable to unmarshal config, error: %v", err)
+		logs.err(err).fatalf("Unable to unmarshal config")
 	}
 
-	// OpusEncoder is used to encode the Output file to discord's own DCA format
-	opusEncoder, err = opus.NewEncoder(audioFrameRate, audioChannels, opus.AppAudio)
+	err = c.validate()
 	if err != nil {
-		log.Fatalf("An error occured with initializing the OpusEncoder, error: %v", err)
+		logs.err(err).fatalf("Invalid config")
 	}
 
-	opusEncoder.SetBitrate(audioBitrate * 1000)
+	setconfig(c, getcatalogs())
+	setuplogging()
 
-	// This goroutine manages the newly-added songs, whenever a new song is added it calls
-	// send() to stream it to discord, and then cleans the file for another song to be played.
-	// If there are any problems with the queue, most likely it's from this function alone.
-	go func() {
-
-		for {
-			if len(queue) > queueindex && queueindex >= 0 {
-
-				if pause {
-					pause = false
-				}
+	cats, err := loadcatalogs(c.LocalesPath)
+	if err != nil {
+		logs.err(err).fatalf("Cannot load the message catalogs")
+	}
 
-				vid := queue[queueindex]
-				playingAudio = true
-				// close
-
-				var format *ytdl.Format
-				minsize := int64(0)
-				for _, v := range vid.Base.Formats.Type("audio") {
-					if format == nil || (format != nil && minsize > v.ContentLength) {
-						format = &v
-						fmt.Println("hi", format.MimeType, v.ContentLength)
-						minsize = v.ContentLength
-					}
-				}
+	err = c.checklanguages(cats)
+	if err != nil {
+		logs.err(err).fatalf("Invalid config")
+	}
 
-				fmt.Println(len(vid.Base.Formats), vid.Base.Formats[0].MimeType)
-				fmt.Println("last", format.MimeType)
-				dl, _, err := ytcl.GetStream(vid.Base, format)
-				if err != nil {
-					log.Fatalf("ytcl.GetStream: %s", err.Error())
-				}
+	setconfig(c, cats)
 
-				rd := bufio.NewReaderSize(dl, bufferSize)
-				time.Sleep(time.Second)
+	err = loadguildmessages()
+	if err != nil {
+		logs.err(err).fatalf("Cannot load the messages of the guilds")
+	}
 
-				send(rd)
-				dl.Close()
-			}
+	err = loadguildaliases()
+	if err != nil {
+		logs.err(err).fatalf("Cannot load the aliases of the guilds")
+	}
 
-			time.Sleep(time.Second)
+	if c.DcaRecord {
+		err = os.MkdirAll(c.DcaPath, 0755)
+		if err != nil {
+			logs.err(err).fatalf("Cannot create the DCA directory")
 		}
+	}
 
-	}()
+	// The console replaces discord, youtube, the api, the metrics and the reloads
+	if *consoleFlag {
+		err = runconsole()
+		if err != nil {
+			logs.err(err).fatalf("Cannot run the console")
+		}
 
-	// Create a new session, this initializes the session to add handlers
-	sesh, err = discordgo.New(fmt.Sprintf("Bot %s", config.BotToken))
-	if err != nil {
-		log.Fatalf("An error occured with creating a new session, error: %v", err)
+		return
 	}
 
-	// Add a message handler to sort commands from regular messages
-	sesh.AddHandler(messageHandler)
-
-	// Open a websocket connection, to make the bot online and useable to users.
-	err = sesh.Open()
+	// Open a websocket connection per shard of every bot, to make the bots online and useable to users.
+	err = openbots(c.tokens(), c.Shards)
 	if err != nil {
-		log.Fatalf("An error occured with opening the websocket connecting, error: %v", err)
+		logs.err(err).fatalf("An error occured with opening the websocket connecting")
 	}
 
-	if len(config.Status) > 0 {
-		fmt.Println(sesh.UpdateListeningStatus(config.Status))
+	if len(c.Status) > 0 {
+		setstatus(c.Status)
 	}
 
 	client := &http.Client{
-		Transport: &transport.APIKey{Key: config.YoutubeKey},
+		Transport: &transport.APIKey{Key: c.YoutubeKey},
 	}
 
 	yt, err = youtube.New(client)
 	if err != nil {
-		log.Fatalf("Error creating new YouTube client: %v", err)
+		logs.err(err).fatalf("Error creating new YouTube client")
 	}
 
-	log.Println("Session created successfully")
-	sig := make(chan os.Signal)
-	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, os.Kill, syscall.SIGINT)
-	<-sig
+	if len(c.MetricsAddress) > 0 {
+		err = startmetrics()
+		if err != nil {
+			logs.err(err).fatalf("Cannot serve the metrics")
+		}
 
-	// Close the session
-	sesh.Close()
-	log.Println("Closed Session")
-}
+		logs.infof("The metrics are served on %s/metrics", c.MetricsAddress)
+	}
+
+	// The api searches youtube, so it starts once the client exists
+	if len(c.API.Address) > 0 {
+		err = startapi()
+		if err != nil {
+			logs.err(err).fatalf("Cannot start the api")
+		}
 
-func setqueueindex(v int) {
-	if len(queue) >= v {
-		queueindex = v
+		logs.infof("The api is listening on %s", c.API.Address)
 	}
+
+	// Edits of the config file apply while the bot runs
+	watchconfig()
+
+	logs.infof("Session created successfully")
+	waitforshutdown(nil)
+	logs.infof("Closed Session")
+}
+
+// formatduration formats d as minutes and seconds, i.e 03:07
+func formatduration(d time.Duration) string {
+	d = d.Round(time.Second)
+	m := int(math.Floor(d.Minutes()))
+	s := int(d.Seconds()) % 60
+
+	return fmt.Sprintf("%02d:%02d", m, s)
 }
 
 func replacestringwithtrackinfo(str string, track *videoInfo) string {
 
 	base := track.Base
-	d := base.Duration.Round(time.Second)
-	m := int(math.Floor(d.Minutes()))
-	s := int(d.Seconds()) % 60
 
-	duration := fmt.Sprintf("%02d:%02d", m, s)
+	// link is the title as a markdown link, DCA files don't have one
+	link := base.Title
+	if url := videourl(track); len(url) > 0 {
+		link = fmt.Sprintf("[%s](%s)", base.Title, url)
+	}
 
 	replaces := strings.NewReplacer(
 		"{{title}}", base.Title,
+		"{{link}}", link,
 		"{{id}}", base.ID,
 		"{{description}}", base.Description,
 		"{{publishdate}}", base.PublishDate.Format("2006/01/02"),
 		"{{author}}", base.Author,
-		"{{duration}}", duration,
+		"{{duration}}", formatduration(base.Duration),
 		"{{name}}", track.Name)
 
 	return replaces.Replace(str)
 }
 
+// messageHandler passes the messages that a shard gets to its bot.
 func messageHandler(s *discordgo.Session, m *discordgo.MessageCreate) {
+	b := botof(s)
+	if b == nil {
+		return
+	}
+
+	b.handlemessage(discordSession{s}, m)
+}
+
+// handlemessage runs the command of a message in the background, if the bot is the one that answers it.
+func (b *bot) handlemessage(s session, m *discordgo.MessageCreate) {
 	// If the author of the message is the same as the bot
 	// i.e if the bot sent the message
-	if m.Author.ID == s.State.User.ID {
+	if m.Author.ID == s.user().ID {
 		return
 	}
 
-	if !strings.HasPrefix(m.Content, config.Prefix) {
+	// The other bots of the process, and every other bot, would make the bots answer each other
+	if m.Author.Bot {
 		return
 	}
 
-	m.Content = strings.TrimPrefix(m.Content, config.Prefix)
-	split := strings.Split(m.Content, " ")
+	// The prefix could change while the message is handled when the config is reloaded
+	prefix := getconfig().Prefix
+	if !strings.HasPrefix(m.Content, prefix) {
+		return
+	}
 
-	if len(split) > 0 {
-		var cmd *command
-		for _, v := range commands {
-			for _, alias := range v.alias {
-				if alias == split[0] {
-					cmd = v
-					break
-				}
-			}
-		}
+	// Players belong to guilds, so commands cannot be used in direct messages
+	if m.GuildID == "" {
+		return
+	}
 
-		if cmd != nil {
-			cp := &commandParameter{
-				m,
-				cmd,
-				split,
-			}
+	// The players are stopping, so the commands would be cut off
+	if isshuttingdown() {
+		return
+	}
 
-			if cmd.callback != nil {
-				go cmd.callback(s, cp)
-			}
+	// Every bot in the guild gets the message, only one of them answers
+	if !b.handles(m) {
+		return
+	}
+
+	m.Content = strings.TrimPrefix(m.Content, prefix)
+
+	// The command's name ends at the first space, the rest are its arguments
+	content := strings.TrimLeftFunc(m.Content, unicode.IsSpace)
+	name, rest := content, ""
+	if i := strings.IndexFunc(content, unicode.IsSpace); i >= 0 {
+		name, rest = content[:i], content[i:]
+	}
+
+	cmd := findguildcommand(m.GuildID, name)
+	if cmd == nil {
+		// Without a prefix every message would look like a command, so chatting would get suggestions
+		if len(prefix) == 0 {
+			return
 		}
+
+		// The help command holds the message, since it's the one that lists the commands
+		if suggestion := suggestcommand(m.GuildID, name); len(suggestion) > 0 {
+			replaces := strings.NewReplacer(
+				"{{command}}", name,
+				"{{suggestion}}", prefix+suggestion)
+			s.ChannelMessageSend(m.ChannelID, replaces.Replace(message(m.GuildID, findcommand("help"), "unknown")))
+		}
+
+		return
 	}
 
+	p, err := b.getplayer(m.GuildID)
+	if err != nil {
+		logs.with("guild", m.GuildID).err(err).errorf("Cannot create the player")
+		metricCommands.inc(cmd.alias[0], "error")
+		return
+	}
+
+	p.mu.Lock()
+	p.textchannel = m.ChannelID
+	p.mu.Unlock()
+
+	cp := &commandParameter{
+		MessageCreate: m,
+		cmd:           cmd,
+		player:        p,
+	}
+
+	cp.args, err = parseargs(cmd.args, rest)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, usagemessage(cp, err))
+		metricCommands.inc(cmd.alias[0], "usage")
+		return
+	}
+
+	if cmd.callback != nil {
+		runningCommands.Add(1)
+		go runcommand(s, cp)
+	}
 }
 
-func cmdPlay(s *discordgo.Session, m *commandParameter) {
-	if len(m.Split) >= 2 {
-		urlstring := m.Split[1]
-		uri, err := url.ParseRequestURI(urlstring)
-		yturl := ""
-		if err == nil {
-			yturl = uri.String()
+// runningCommands counts the commands that are running, the console waits for every command before it runs the next one
+var runningCommands sync.WaitGroup
+
+// runcommand runs the callback of a command, a command that panics is logged instead of crashing the bot.
+func runcommand(s session, m *commandParameter) {
+	defer runningCommands.Done()
+	defer func() {
+		if r := recover(); r != nil {
+			m.log().with("panic", fmt.Sprint(r)).with("stack", string(debug.Stack())).errorf("The command panicked")
+			metricCommands.inc(m.cmd.alias[0], "panic")
+		}
+	}()
+
+	m.cmd.callback(s, m)
+	metricCommands.inc(m.cmd.alias[0], "ok")
+}
+
+func cmdPlay(s session, m *commandParameter) {
+	p := m.player
+	if m.args.has("query") {
+		vid, err := findvideo(m.args.str("query"))
+		if err == errNoVideos {
+			s.ChannelMessageSend(m.ChannelID, m.message("empty"))
+		} else if err != nil {
+			m.log().err(err).warnf("Cannot find %s", m.args.str("query"))
 		} else {
-			for k, v := range m.Split[1:] {
-				if k+1 != len(m.Split) {
-					urlstring += v + " "
-				}
-			}
+			addtoqueue(s, m, &videoInfo{
+				Base:      vid,
+				Name:      "@" + m.Author.String(),
+				Requester: m.Author,
+			})
+		}
+	} else if p.setpause(false) {
+		// cmdResume isn't used since play doesn't have the message of resume
+		s.ChannelMessageSend(m.ChannelID, message(m.GuildID, findcommand("resume"), "resume"))
+	}
+}
 
-			call := yt.Search.List([]string{"id"}).Q(urlstring).MaxResults(1).Type("video")
+var errNoVideos = errors.New("no videos found")
 
-			res, err := call.Do()
-			if err != nil {
-				return
-				//s.ChannelMessageSend(m.ChannelID, "An error error occured with searching for the video, please consult @toms#1441")
-			}
+// findvideo finds the videos of the play commands and the api, the tests replace it so that they don't need youtube
+var findvideo = resolvevideo
 
-			if len(res.Items) > 0 {
-				yturl = "https://youtube.com/watch?v=" + res.Items[0].Id.VideoId
+// resolvevideo returns the video of a youtube url, or the first video that youtube finds for query.
+func resolvevideo(query string) (*ytdl.Video, error) {
+	uri, err := url.ParseRequestURI(query)
+	if err == nil {
+		return ytcl.GetVideo(uri.String())
+	}
+
+	res, err := yt.Search.List([]string{"id"}).Q(query).MaxResults(1).Type("video").Do()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res.Items) == 0 {
+		return nil, errNoVideos
+	}
+
+	return ytcl.GetVideo("https://youtube.com/watch?v=" + res.Items[0].Id.VideoId)
+}
+
+// addtoqueue appends newvid to the queue, and joins the user's voice channel if the bot isn't in one.
+func addtoqueue(s session, m *commandParameter, newvid *videoInfo) {
+	p := m.player
+	p.enqueue(newvid)
+
+	s.ChannelMessageSend(m.ChannelID, replacestringwithtrackinfo(m.message("success"), newvid))
+
+	// cmdJoin isn't used since it would send the messages of m's command
+	if !p.connected() {
+		if channelID := uservoicechannel(s, m.GuildID, m.Author.ID); len(channelID) > 0 {
+			err := p.join(s, channelID)
+			if err != nil {
+				m.log().err(err).warnf("Cannot join %s", channelID)
 			}
 		}
+	}
+}
 
-		if len(yturl) > 0 {
-			vid, err := ytcl.GetVideo(yturl)
-			if err == nil {
+// dcafile returns the path of the DCA file called name inside config.DcaPath.
+// Only the base name is used, so users cannot read files outside of config.DcaPath.
+func dcafile(name string) string {
+	name = filepath.Base(name)
+	if !strings.HasSuffix(name, dcaExtension) {
+		name += dcaExtension
+	}
 
-				newvid := &videoInfo{
-					Base: vid,
-					Name: "@" + m.Author.String(),
-				}
+	return filepath.Join(getconfig().DcaPath, name)
+}
 
-				oldlen := len(queue)
-				queue = append(queue, newvid)
+func cmdPlayDCA(s session, m *commandParameter) {
+	file := dcafile(m.args.str("file"))
+	name := strings.TrimSuffix(filepath.Base(file), dcaExtension)
 
-				s.ChannelMessageSend(m.ChannelID, replacestringwithtrackinfo(m.cmd.messages["success"], newvid))
+	f, err := os.Open(file)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, strings.ReplaceAll(m.message("notfound"), "{{file}}", name))
+		return
+	}
+	defer f.Close()
 
-				if vc == nil {
-					cmdJoin(s, m)
-				}
+	base := &ytdl.Video{
+		ID:    name,
+		Title: name,
+	}
 
-				// If we have a clear queue, set queueindex to 0 to initiate the first song.
-				if queueindex < 0 && oldlen == 0 {
-					setqueueindex(0)
-				}
-			}
-		} else {
-			s.ChannelMessageSend(m.ChannelID, m.cmd.messages["empty"])
+	rd, err := newDCAReader(f)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, strings.ReplaceAll(m.message("notfound"), "{{file}}", name))
+		return
+	}
+
+	if rd.Metadata != nil && rd.Metadata.Info != nil {
+		if len(rd.Metadata.Info.Title) > 0 {
+			base.Title = rd.Metadata.Info.Title
 		}
-	} else {
-		if pause {
-			cmdResume(s, m)
-		} else {
-			setqueueindex(queueindex)
+		base.Author = rd.Metadata.Info.Artist
+	}
+
+	addtoqueue(s, m, &videoInfo{
+		Base:      base,
+		Name:      "@" + m.Author.String(),
+		Requester: m.Author,
+		File:      file,
+	})
+}
+
+func cmdDCAFiles(s session, m *commandParameter) {
+	files, _ := filepath.Glob(filepath.Join(getconfig().DcaPath, "*"+dcaExtension))
+
+	str := ""
+	for _, v := range files {
+		name := strings.TrimSuffix(filepath.Base(v), dcaExtension)
+		// The songs that are currently being recorded aren't playable yet
+		if strings.HasSuffix(v, dcaFilename) {
+			continue
 		}
+
+		if len(str) > 0 {
+			str += "\n"
+		}
+		str += strings.ReplaceAll(m.message("loop"), "{{file}}", name)
+	}
+
+	if len(str) == 0 {
+		str = m.message("empty")
+	} else {
+		str = m.message("start") + str + m.message("end")
 	}
+
+	s.ChannelMessageSend(m.ChannelID, str)
 }
 
-func cmdQueue(s *discordgo.Session, m *commandParameter) {
+func cmdQueue(s session, m *commandParameter) {
+	p := m.player
+
+	p.mu.Lock()
+	queue, i := p.queue, p.queueindex
+	p.mu.Unlock()
 
 	var str string
 	if len(queue) > 0 {
-		str = m.cmd.messages["start"]
+		str = m.message("start")
 
-		var i = queueindex
 		var start, end int
 
 		if len(queue) > i+25 || len(queue) == i+25 {
@@ -492,6 +907,11 @@ func cmdQueue(s *discordgo.Session, m *commandParameter) {
 			start = 0
 		}
 
+		if canembed(s, m.ChannelID) {
+			s.ChannelMessageSendEmbed(m.ChannelID, queueembed(m, start, end))
+			return
+		}
+
 		/*
 			Three cases:
 			First case:
@@ -511,7 +931,7 @@ func cmdQueue(s *discordgo.Session, m *commandParameter) {
 
 				if v != nil {
 
-					newstr := replacestringwithtrackinfo(m.cmd.messages["loop"], v)
+					newstr := replacestringwithtrackinfo(m.message("loop"), v)
 					newstr = strings.ReplaceAll(newstr, "{{index}}", fmt.Sprintf("%02d", i+1))
 
 					str += newstr
@@ -523,94 +943,114 @@ func cmdQueue(s *discordgo.Session, m *commandParameter) {
 			}
 		}
 
-		str += m.cmd.messages["end"]
+		str += m.message("end")
 	} else {
-		str = m.cmd.messages["empty"]
+		str = m.message("empty")
 	}
 
 	s.ChannelMessageSend(m.ChannelID, str)
 }
 
-func cmdSkip(s *discordgo.Session, m *commandParameter) {
-	pause = false
-	if queueindex >= 0 {
-		i := queueindex + 1
-		if i <= len(queue) {
-			setqueueindex(i)
-
-			if len(m.cmd.messages["skip"]) > 0 {
-				s.ChannelMessageSend(m.ChannelID, m.cmd.messages["skip"])
-			}
-		}
+func cmdSkip(s session, m *commandParameter) {
+	p := m.player
+	if p.skip() && len(m.message("skip")) > 0 {
+		s.ChannelMessageSend(m.ChannelID, m.message("skip"))
 	}
 }
 
-func cmdLoop(s *discordgo.Session, m *commandParameter) {
-	if len(m.Split) >= 2 {
-		state := m.Split[1]
-		if state == "off" {
-			loop = loopOff
-		} else if state == "song" {
-			loop = loopSong
-		} else if state == "playlist" || state == "queue" {
-			loop = loopQueue
-		}
+func cmdLoop(s session, m *commandParameter) {
+	p := m.player
+
+	p.mu.Lock()
+	mode := p.loop
+	p.mu.Unlock()
+
+	if m.args.has("mode") {
+		mode = loopModes[m.args.str("mode")]
+	} else if mode == loopQueue {
+		mode = loopOff
 	} else {
-		loop = loop + 1
-		if loop > loopQueue {
-			loop = loopOff
-		}
+		mode++
 	}
 
+	p.setloop(mode)
+
 	str := ""
-	if loop == loopOff {
-		str = m.cmd.messages["off"]
-	} else if loop == loopSong {
-		str = m.cmd.messages["song"]
-	} else if loop == loopQueue {
-		str = m.cmd.messages["queue"]
+	if mode == loopOff {
+		str = m.message("off")
+	} else if mode == loopSong {
+		str = m.message("song")
+	} else if mode == loopQueue {
+		str = m.message("queue")
 	}
 
 	s.ChannelMessageSend(m.ChannelID, str)
 }
 
-func cmdJoin(s *discordgo.Session, m *commandParameter) {
+func cmdJoin(s session, m *commandParameter) {
+	p := m.player
 
-	if vc != nil {
-		s.ChannelMessageSend(m.ChannelID, m.cmd.messages["already_in"])
+	if p.connected() {
+		s.ChannelMessageSend(m.ChannelID, m.message("already_in"))
+		return
 	}
 
-	channel, err := s.State.Channel(m.ChannelID)
-	if err != nil {
+	channelID := uservoicechannel(s, m.GuildID, m.Author.ID)
+	if channelID == "" {
+		s.ChannelMessageSend(m.ChannelID, m.message("no_channel"))
 		return
 	}
 
-	guild, err := s.State.Guild(channel.GuildID)
+	err := p.join(s, channelID)
 	if err != nil {
-		return
+		m.log().err(err).warnf("Cannot join %s", channelID)
 	}
 
-	for _, vs := range guild.VoiceStates {
-		if vs.UserID == m.Author.ID {
-			vc, _ = s.ChannelVoiceJoin(vs.GuildID, vs.ChannelID, false, true)
-			if len(m.cmd.messages["success"]) > 0 {
-				s.ChannelMessageSend(m.ChannelID, m.cmd.messages["success"])
-			}
+	if len(m.message("success")) > 0 {
+		s.ChannelMessageSend(m.ChannelID, m.message("success"))
+	}
+}
+
+func cmdSummon(s session, m *commandParameter) {
+	p := m.player
+
+	channelID := m.args.str("channel")
+	if len(channelID) > 0 {
+		ch, err := s.state().Channel(channelID)
+		if err != nil || ch.GuildID != m.GuildID || (ch.Type != discordgo.ChannelTypeGuildVoice && ch.Type != discordgo.ChannelTypeGuildStageVoice) {
+			s.ChannelMessageSend(m.ChannelID, m.message("not_voice"))
 			return
 		}
+	} else {
+		channelID = uservoicechannel(s, m.GuildID, m.Author.ID)
+	}
+
+	if channelID == "" {
+		s.ChannelMessageSend(m.ChannelID, m.message("no_channel"))
+		return
 	}
 
-	s.ChannelMessageSend(m.ChannelID, m.cmd.messages["no_voice"])
+	p.mu.Lock()
+	inside := p.vc != nil && p.channelID == channelID
+	p.mu.Unlock()
+
+	if inside {
+		s.ChannelMessageSend(m.ChannelID, m.message("already_in"))
+		return
+	}
+
+	err := p.move(s, channelID)
+	if err != nil {
+		m.log().err(err).warnf("Cannot move to %s", channelID)
+		return
+	}
+
+	s.ChannelMessageSend(m.ChannelID, m.message("success"))
 }
 
-func cmdPlaySample(s *discordgo.Session, m *commandParameter) {
+func cmdPlaySample(s session, m *commandParameter) {
 	addsong := func(str string) {
-		if len(m.Split) >= 2 {
-			m.Split[1] = str
-		} else {
-			m.Split = append(m.Split, str)
-		}
-
+		m.args = arguments{"query": str}
 		cmdPlay(s, m)
 	}
 
@@ -619,134 +1059,169 @@ func cmdPlaySample(s *discordgo.Session, m *commandParameter) {
 	}
 }
 
-func cmdVolume(s *discordgo.Session, m *commandParameter) {
-	if len(m.Split) >= 2 {
-		vol, err := strconv.Atoi(m.Split[1])
-		if err == nil {
-			if vol <= 100 && vol >= 0 {
-				volume = float64(vol) / 100
-			}
-		}
+func cmdVolume(s session, m *commandParameter) {
+	p := m.player
+	if vol, ok := m.args.integer("volume"); ok {
+		p.setvolume(vol)
 	}
 
-	str := m.cmd.messages["volume"]
+	p.mu.Lock()
+	volume := p.volume
+	p.mu.Unlock()
+
+	str := m.message("volume")
 	str = strings.ReplaceAll(str, "{{volume}}", fmt.Sprintf("%02d", int(volume*100)))
 
 	s.ChannelMessageSend(m.ChannelID, str)
 }
 
-func cmdPause(s *discordgo.Session, m *commandParameter) {
-	if !pause {
-		s.ChannelMessageSend(m.ChannelID, m.cmd.messages["pause"])
+func cmdPause(s session, m *commandParameter) {
+	p := m.player
+	if p.setpause(true) {
+		s.ChannelMessageSend(m.ChannelID, m.message("pause"))
 	}
-
-	pause = true
 }
 
-func cmdResume(s *discordgo.Session, m *commandParameter) {
-	if pause {
-		s.ChannelMessageSend(m.ChannelID, m.cmd.messages["resume"])
+func cmdResume(s session, m *commandParameter) {
+	p := m.player
+	if p.setpause(false) {
+		s.ChannelMessageSend(m.ChannelID, m.message("resume"))
 	}
-
-	pause = false
 }
 
-func cmdSetName(s *discordgo.Session, m *commandParameter) {
-	name := ""
+func cmdSetName(s session, m *commandParameter) {
+	old := s.user().Username
+	name := m.args.str("name")
 
-	if len(m.Split) >= 2 {
-		for k, v := range m.Split[1:] {
-			if k+1 != len(m.Split) {
-				name += v + " "
-			}
-		}
+	_, err := s.UserUpdate(name, "")
+	if err == nil {
+		replaces := strings.NewReplacer(
+			"{{old}}", old,
+			"{{new}}", name)
 
-		_, err := s.UserUpdate("", "", name, "", "")
-		if err == nil {
-			s.ChannelMessageSend(m.ChannelID, m.cmd.messages["setname"])
-		} else {
-			s.ChannelMessageSend(m.ChannelID, m.cmd.messages["ratelimit"])
-		}
+		s.ChannelMessageSend(m.ChannelID, replaces.Replace(m.message("setname")))
 	} else {
-		s.ChannelMessageSend(m.ChannelID, m.cmd.messages["param"])
+		s.ChannelMessageSend(m.ChannelID, m.message("ratelimit"))
 	}
-
 }
 
-func cmdSetAvatar(s *discordgo.Session, m *commandParameter) {
+func cmdSetAvatar(s session, m *commandParameter) {
 	avatar := ""
 
 	if len(m.Attachments) > 0 {
 		avatar = m.Attachments[0].URL
+	} else if m.args.has("url") {
+		avatar = m.args.str("url")
 	} else {
-		if len(m.Split) >= 2 {
-			avatar = m.Split[1]
-			_, err := url.ParseRequestURI(avatar)
-			if err != nil {
-				avatar = ""
-
-				s.ChannelMessageSend(m.ChannelID, m.cmd.messages["param"])
+		s.ChannelMessageSend(m.ChannelID, m.message("param"))
+		return
+	}
 
-				return
-			}
-		}
+	resp, err := http.Get(avatar)
+	if err != nil {
+		logs.err(err).warnf("Cannot download the avatar")
+		s.ChannelMessageSend(m.ChannelID, m.message("error"))
+		return
 	}
+	defer resp.Body.Close()
 
-	if avatar != "" {
-		resp, err := http.Get(avatar)
-		if err == nil {
-			defer resp.Body.Close()
-			img, err := ioutil.ReadAll(resp.Body)
-			if err == nil {
-				contentType := http.DetectContentType(img)
-				base64img := base64.StdEncoding.EncodeToString(img)
+	img, err := ioutil.ReadAll(resp.Body)
+	if err == nil {
+		contentType := http.DetectContentType(img)
+		base64img := base64.StdEncoding.EncodeToString(img)
 
-				avatar := fmt.Sprintf("data:%s;base64,%s", contentType, base64img)
-				s.UserUpdate("", "", "", avatar, "")
+		// Discord refuses images that are too big or aren't images, and changing the avatar is rate limited
+		_, err = s.UserUpdate("", fmt.Sprintf("data:%s;base64,%s", contentType, base64img))
+	}
 
-				s.ChannelMessageSend(m.ChannelID, m.cmd.messages["setavatar"])
-			}
-		}
+	if err != nil {
+		logs.err(err).warnf("Cannot change the avatar")
+		s.ChannelMessageSend(m.ChannelID, m.message("error"))
+		return
 	}
+
+	s.ChannelMessageSend(m.ChannelID, m.message("setavatar"))
 }
 
-func cmdShuffle(s *discordgo.Session, m *commandParameter) {
-	shuffle = !shuffle
+func cmdShuffle(s session, m *commandParameter) {
+	p := m.player
+
+	p.mu.Lock()
+	shuffle := !p.shuffle
+	p.mu.Unlock()
+
+	p.setshuffle(shuffle)
 	if shuffle {
-		s.ChannelMessageSend(m.ChannelID, m.cmd.messages["on"])
+		s.ChannelMessageSend(m.ChannelID, m.message("on"))
 	} else {
-		s.ChannelMessageSend(m.ChannelID, m.cmd.messages["off"])
+		s.ChannelMessageSend(m.ChannelID, m.message("off"))
 	}
 
 }
 
-func cmdClear(s *discordgo.Session, m *commandParameter) {
-	queue = []*videoInfo{}
-	setqueueindex(-1)
+func cmdClear(s session, m *commandParameter) {
+	p := m.player
+	p.clearqueue()
+
+	s.ChannelMessageSend(m.ChannelID, m.message("clear"))
+}
 
-	s.ChannelMessageSend(m.ChannelID, m.cmd.messages["clear"])
+func cmdSeek(s session, m *commandParameter) {
+	p := m.player
+	position, _ := m.args.duration("position")
+
+	err := p.seek(position)
+	if err == errSeekEnd {
+		s.ChannelMessageSend(m.ChannelID, m.message("toolong"))
+	} else if err != nil {
+		s.ChannelMessageSend(m.ChannelID, m.message("nothing"))
+	} else {
+		s.ChannelMessageSend(m.ChannelID, strings.ReplaceAll(m.message("success"), "{{position}}", formatduration(position)))
+	}
 }
 
-func cmdHelp(s *discordgo.Session, m *commandParameter) {
+func cmdRemove(s session, m *commandParameter) {
+	p := m.player
+	number, _ := m.args.integer("number")
+
+	vid, err := p.removesong(number - 1)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, m.message("notfound"))
+		return
+	}
+
+	s.ChannelMessageSend(m.ChannelID, replacestringwithtrackinfo(m.message("success"), vid))
+}
+
+func cmdHelp(s session, m *commandParameter) {
 
 	chn, err := s.UserChannelCreate(m.Author.ID)
 	if err == nil {
-		str := m.cmd.messages["start"]
+		// Embeds are always allowed in direct messages
+		_, err = s.ChannelMessageSendEmbeds(chn.ID, helpembeds(m))
+		if err == nil {
+			if len(m.message("success")) > 0 {
+				s.ChannelMessageSend(m.ChannelID, m.message("success"))
+			}
+			return
+		}
+
+		str := m.message("start")
 		for _, v := range commands {
 
 			name := v.alias[0]
 			name = strings.Title(name)
 
-			alias := m.cmd.messages["startalias"]
+			alias := m.message("startalias")
 			for k, val := range v.alias {
 				alias += val
 				if k+1 < len(v.alias) {
 					alias += ","
 				}
 			}
-			alias += m.cmd.messages["endalias"]
+			alias += m.message("endalias")
 
-			format := m.cmd.messages["cmd"]
+			format := m.message("cmd")
 
 			format = strings.ReplaceAll(format, "{{alias}}", alias)
 			format = strings.ReplaceAll(format, "{{name}}", name)
@@ -755,33 +1230,30 @@ func cmdHelp(s *discordgo.Session, m *commandParameter) {
 			str += format
 		}
 
-		str += m.cmd.messages["end"]
+		str += m.message("end")
 
 		_, err := s.ChannelMessageSend(chn.ID, str)
 		if err != nil {
-			s.ChannelMessageSend(m.ChannelID, m.cmd.messages["error"])
+			s.ChannelMessageSend(m.ChannelID, m.message("error"))
 			return
 		}
-		if len(m.cmd.messages["success"]) > 0 {
-			s.ChannelMessageSend(m.ChannelID, m.cmd.messages["success"])
+		if len(m.message("success")) > 0 {
+			s.ChannelMessageSend(m.ChannelID, m.message("success"))
 		}
 	} else {
-		s.ChannelMessageSend(m.ChannelID, m.cmd.messages["error"])
+		s.ChannelMessageSend(m.ChannelID, m.message("error"))
 	}
 }
 
-func cmdLeave(s *discordgo.Session, m *commandParameter) {
-	if vc != nil {
-
-		cmdSkip(s, m)
+func cmdLeave(s session, m *commandParameter) {
+	p := m.player
+	if p.connected() {
+		// The song is skipped without the message of skip, leave has none
+		p.skip()
 
-		go func() {
-			time.Sleep(time.Millisecond * 50)
-			vc.Disconnect()
-			vc = nil
-		}()
+		go p.leave()
 
 	} else {
-		s.ChannelMessageSend(m.ChannelID, m.cmd.messages["novoice"])
+		s.ChannelMessageSend(m.ChannelID, m.message("novoice"))
 	}
 }
@@ -0,0 +1,786 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	ytdl "github.com/kkdai/youtube/v2"
+)
+
+func TestMain(m *testing.M) {
+	// The tables of the tests use the commands and the prefix
+	editconfig(func(c *Config) { c.Prefix = "!" })
+	err := registercommands(commands)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	os.Exit(m.Run())
+}
+
+// msg returns the message of a command in testGuild.
+func msg(name, key string) string {
+	return message(testGuild, findcommand(name), key)
+}
+
+// usagefor returns the message that the parser sends when args aren't valid arguments of a command.
+func usagefor(name, args string) string {
+	cmd := findcommand(name)
+	_, err := parseargs(cmd.args, args)
+
+	m := &commandParameter{MessageCreate: newmessage(testUser, ""), cmd: cmd}
+	return usagemessage(m, err)
+}
+
+// song returns a song of the queue that is three minutes long.
+func song(title string) *videoInfo {
+	return &videoInfo{
+		Base: &ytdl.Video{ID: strings.ToLower(title), Title: title, Duration: 3 * time.Minute},
+		Name: "@user",
+	}
+}
+
+// fakevideos makes the play commands find a video titled like the query, or no video if the query is nothing.
+func fakevideos(t *testing.T) {
+	findvideo = func(query string) (*ytdl.Video, error) {
+		if query == "nothing" {
+			return nil, errNoVideos
+		}
+
+		return &ytdl.Video{ID: query, Title: query}, nil
+	}
+
+	t.Cleanup(func() {
+		findvideo = resolvevideo
+	})
+}
+
+// writedca writes a DCA file called name with frames opus frames of 20ms to config.DcaPath.
+func writedca(t *testing.T, name, title string, frames int) {
+	f, err := os.Create(filepath.Join(getconfig().DcaPath, name+dcaExtension))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	wr, err := newDCAWriter(f, newDCAMetadata(&videoInfo{Base: &ytdl.Video{ID: name, Title: title}}, getconfig().Audio))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < frames; i++ {
+		// A CELT frame of 20ms
+		err = wr.WriteFrame([]byte{0xfc, 0xff, 0xfe})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHandleMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		m       *discordgo.MessageCreate
+		prepare func()
+		want    []string
+		counted bool
+	}{
+		{
+			name: "without the prefix",
+			m:    newmessage(testUser, "play something"),
+		},
+		{
+			name: "sent by the bot",
+			m:    newmessage(testBot, "!skip"),
+		},
+		{
+			name: "sent by another bot",
+			m: func() *discordgo.MessageCreate {
+				m := newmessage("303", "!pley something")
+				m.Author.Bot = true
+				return m
+			}(),
+		},
+		{
+			name: "direct message",
+			m: func() *discordgo.MessageCreate {
+				m := newmessage(testUser, "!skip")
+				m.GuildID = ""
+				return m
+			}(),
+		},
+		{
+			name:    "shutting down",
+			m:       newmessage(testUser, "!skip"),
+			prepare: func() { atomic.StoreInt32(&shuttingdown, 1) },
+		},
+		{
+			name: "unknown command",
+			m:    newmessage(testUser, "!pley something"),
+			want: []string{"There is no command called **pley**, did you mean **!play**?"},
+		},
+		{
+			name:    "unknown command without a prefix",
+			m:       newmessage(testUser, "okay"),
+			prepare: func() { editconfig(func(c *Config) { c.Prefix = "" }) },
+		},
+		{
+			name: "unknown command without suggestion",
+			m:    newmessage(testUser, "!xyzzy"),
+		},
+		{
+			name:    "invalid arguments",
+			m:       newmessage(testUser, "!volume loud"),
+			want:    []string{usagefor("volume", " loud")},
+			counted: true,
+		},
+		{
+			name:    "missing argument",
+			m:       newmessage(testUser, "!playdca"),
+			want:    []string{msg("playdca", "param")},
+			counted: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _ := newtestbot(t)
+			f := newfakesession(t)
+
+			if tt.prepare != nil {
+				tt.prepare()
+				defer atomic.StoreInt32(&shuttingdown, 0)
+			}
+
+			before := commandsrun()
+			b.handlemessage(f, tt.m)
+
+			if got := f.texts(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sent %q, want %q", got, tt.want)
+			}
+
+			if counted := commandsrun() > before; counted != tt.counted {
+				t.Errorf("counted the command: %t, want %t", counted, tt.counted)
+			}
+		})
+	}
+}
+
+func TestCommands(t *testing.T) {
+	avatars := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("\x89PNG\r\n\x1a\n"))
+	}))
+	defer avatars.Close()
+
+	tests := []struct {
+		name   string
+		author string
+		// content is the message without the prefix
+		content string
+		setup   func(t *testing.T, p *player, f *fakeSession)
+		// want are the messages that are sent to the text channel
+		want  []string
+		check func(t *testing.T, p *player, f *fakeSession)
+	}{
+		{
+			name:    "play",
+			content: "play never gonna",
+			want:    []string{"Added **never gonna** to the queue!"},
+			check: func(t *testing.T, p *player, f *fakeSession) {
+				locked(p, func() {
+					if len(p.queue) != 1 || p.queueindex != 0 {
+						t.Errorf("queue has %d songs at %d, want 1 at 0", len(p.queue), p.queueindex)
+					}
+
+					// The author isn't in a voice channel
+					if p.vc != nil {
+						t.Errorf("joined a voice channel")
+					}
+				})
+			},
+		},
+		{
+			name:    "play joins the author",
+			author:  testListener,
+			content: "play never gonna",
+			want:    []string{"Added **never gonna** to the queue!"},
+			check: func(t *testing.T, p *player, f *fakeSession) {
+				locked(p, func() {
+					if p.channelID != testVoice {
+						t.Errorf("joined %q, want %q", p.channelID, testVoice)
+					}
+				})
+			},
+		},
+		{
+			name:    "play without videos",
+			content: "play nothing",
+			want:    []string{msg("play", "empty")},
+		},
+		{
+			name:    "play resumes",
+			content: "play",
+			setup: func(t *testing.T, p *player, f *fakeSession) {
+				p.setpause(true)
+			},
+			want: []string{msg("resume", "resume")},
+			check: func(t *testing.T, p *player, f *fakeSession) {
+				locked(p, func() {
+					if p.pause {
+						t.Errorf("still paused")
+					}
+				})
+			},
+		},
+		{
+			name:    "playdca without the file",
+			content: "playdca missing",
+			want:    []string{"There is no DCA file called **missing**"},
+		},
+		{
+			name:    "playdca",
+			author:  testListener,
+			content: "playdca tune",
+			setup: func(t *testing.T, p *player, f *fakeSession) {
+				writedca(t, "tune", "A Tune", 10)
+			},
+			want: []string{"Added **A Tune** to the queue!"},
+			check: func(t *testing.T, p *player, f *fakeSession) {
+				waitfor(t, "the frames of the song", func() bool {
+					_, frames, _ := f.voice.status()
+					return frames == 10
+				})
+
+				// The queue is over once the song ended
+				waitfor(t, "the end of the song", func() bool {
+					p.mu.Lock()
+					defer p.mu.Unlock()
+
+					return !p.playingAudio && p.queueindex == 1
+				})
+			},
+		},
+		{
+			name:    "dcafiles without files",
+			content: "dcafiles",
+			want:    []string{msg("dcafiles", "empty")},
+		},
+		{
+			name:    "dcafiles",
+			content: "dcafiles",
+			setup: func(t *testing.T, p *player, f *fakeSession) {
+				writedca(t, "one", "One", 1)
+				writedca(t, "two", "Two", 1)
+				// Songs that are being recorded aren't listed
+				writedca(t, testGuild+"-song", "Recording", 1)
+			},
+			want: []string{"```one\ntwo```"},
+		},
+		{
+			name:    "queue empty",
+			content: "queue",
+			want:    []string{msg("queue", "empty")},
+		},
+		{
+			name:    "queue",
+			content: "queue",
+			setup: func(t *testing.T, p *player, f *fakeSession) {
+				p.enqueue(song("A"))
+				p.enqueue(song("B"))
+			},
+			want: []string{"```01. A | @user\n02. B | @user```"},
+		},
+		{
+			name:    "queue embed",
+			content: "queue",
+			setup: func(t *testing.T, p *player, f *fakeSession) {
+				f.allow(discordgo.PermissionEmbedLinks)
+				p.enqueue(song("A"))
+			},
+			want: []string{msg("queue", "title")},
+		},
+		{
+			name:    "nowplaying nothing",
+			content: "nowplaying",
+			want:    []string{msg("nowplaying", "nothing")},
+		},
+		{
+			name:    "nowplaying",
+			content: "np",
+			setup: func(t *testing.T, p *player, f *fakeSession) {
+				p.enqueue(song("A"))
+				locked(p, func() {
+					p.playingAudio = true
+					p.position = 90 * time.Second
+				})
+			},
+			want: []string{"Now playing **A** `01:30/03:00` | @user"},
+		},
+		{
+			name:    "skip nothing",
+			content: "skip",
+		},
+		{
+			name:    "skip",
+			content: "skip",
+			setup: func(t *testing.T, p *player, f *fakeSession) {
+				p.enqueue(song("A"))
+				p.enqueue(song("B"))
+			},
+			want: []string{msg("skip", "skip")},
+			check: func(t *testing.T, p *player, f *fakeSession) {
+				locked(p, func() {
+					if p.queueindex != 1 {
+						t.Errorf("queueindex is %d, want 1", p.queueindex)
+					}
+				})
+			},
+		},
+		{
+			name:    "loop cycles",
+			content: "loop",
+			want:    []string{msg("loop", "song")},
+		},
+		{
+			name:    "loop wraps around",
+			content: "loop",
+			setup: func(t *testing.T, p *player, f *fakeSession) {
+				p.setloop(loopQueue)
+			},
+			want: []string{msg("loop", "off")},
+		},
+		{
+			name:    "loop mode",
+			content: "loop playlist",
+			want:    []string{msg("loop", "queue")},
+			check: func(t *testing.T, p *player, f *fakeSession) {
+				locked(p, func() {
+					if p.loop != loopQueue {
+						t.Errorf("loop is %d, want %d", p.loop, loopQueue)
+					}
+				})
+			},
+		},
+		{
+			name:    "loop invalid mode",
+			content: "loop forever",
+			want:    []string{usagefor("loop", " forever")},
+		},
+		{
+			name:    "join outside of voice",
+			content: "join",
+			want:    []string{msg("join", "no_channel")},
+		},
+		{
+			name:    "join",
+			author:  testListener,
+			content: "join",
+			want:    []string{msg("join", "success")},
+			check: func(t *testing.T, p *player, f *fakeSession) {
+				locked(p, func() {
+					if p.channelID != testVoice || p.vc == nil {
+						t.Errorf("joined %q, want %q", p.channelID, testVoice)
+					}
+				})
+			},
+		},
+		{
+			name:    "join already in",
+			author:  testListener,
+			content: "join",
+			setup: func(t *testing.T, p *player, f *fakeSession) {
+				p.join(f, testOtherVoice)
+			},
+			want: []string{msg("join", "already_in")},
+		},
+		{
+			name:    "summon",
+			author:  testListener,
+			content: "summon",
+			setup: func(t *testing.T, p *player, f *fakeSession) {
+				p.join(f, testOtherVoice)
+			},
+			want: []string{msg("summon", "success")},
+			check: func(t *testing.T, p *player, f *fakeSession) {
+				locked(p, func() {
+					if channelID, _, _ := f.voice.status(); channelID != testVoice || p.channelID != testVoice {
+						t.Errorf("moved to %q, want %q", channelID, testVoice)
+					}
+				})
+			},
+		},
+		{
+			name:    "summon a channel",
+			content: "summon <#" + testOtherVoice + ">",
+			want:    []string{msg("summon", "success")},
+			check: func(t *testing.T, p *player, f *fakeSession) {
+				locked(p, func() {
+					if p.channelID != testOtherVoice {
+						t.Errorf("joined %q, want %q", p.channelID, testOtherVoice)
+					}
+
+					// Nobody listens in the channel
+					if !p.alone || !p.pause {
+						t.Errorf("didn't pause while alone")
+					}
+				})
+			},
+		},
+		{
+			name:    "summon a text channel",
+			content: "summon " + testText,
+			want:    []string{msg("summon", "not_voice")},
+		},
+		{
+			name:    "summon already in",
+			author:  testListener,
+			content: "summon",
+			setup: func(t *testing.T, p *player, f *fakeSession) {
+				p.join(f, testVoice)
+			},
+			want: []string{msg("summon", "already_in")},
+		},
+		{
+			name:    "volume",
+			content: "volume",
+			want:    []string{"Volume is set to **100**"},
+		},
+		{
+			name:    "volume set",
+			content: "volume 50",
+			want:    []string{"Volume is set to **50**"},
+			check: func(t *testing.T, p *player, f *fakeSession) {
+				locked(p, func() {
+					if p.volume != 0.5 {
+						t.Errorf("volume is %f, want 0.5", p.volume)
+					}
+				})
+			},
+		},
+		{
+			name:    "volume out of range",
+			content: "volume 101",
+			want:    []string{usagefor("volume", " 101")},
+		},
+		{
+			name:    "pause",
+			content: "pause",
+			want:    []string{msg("pause", "pause")},
+			check: func(t *testing.T, p *player, f *fakeSession) {
+				locked(p, func() {
+					if !p.pause {
+						t.Errorf("didn't pause")
+					}
+				})
+			},
+		},
+		{
+			name:    "pause paused",
+			content: "pause",
+			setup: func(t *testing.T, p *player, f *fakeSession) {
+				p.setpause(true)
+			},
+		},
+		{
+			name:    "resume",
+			content: "resume",
+			setup: func(t *testing.T, p *player, f *fakeSession) {
+				p.setpause(true)
+			},
+			want: []string{msg("resume", "resume")},
+		},
+		{
+			name:    "resume playing",
+			content: "resume",
+		},
+		{
+			name:    "setname",
+			content: "setname New Name",
+			want:    []string{"Change the bot's name from **Bot** to **New Name**"},
+			check: func(t *testing.T, p *player, f *fakeSession) {
+				if f.user().Username != "New Name" {
+					t.Errorf("name is %q, want %q", f.user().Username, "New Name")
+				}
+			},
+		},
+		{
+			name:    "setname rate limited",
+			content: "setname New Name",
+			setup: func(t *testing.T, p *player, f *fakeSession) {
+				f.ratelimited = true
+			},
+			want: []string{msg("setname", "ratelimit")},
+		},
+		{
+			name:    "setname without a name",
+			content: "setname",
+			want:    []string{msg("setname", "param")},
+		},
+		{
+			name:    "setavatar without an image",
+			content: "setavatar",
+			want:    []string{msg("setavatar", "param")},
+		},
+		{
+			name:    "setavatar",
+			content: "setavatar " + avatars.URL + "/avatar.png",
+			want:    []string{msg("setavatar", "setavatar")},
+			check: func(t *testing.T, p *player, f *fakeSession) {
+				if !strings.HasPrefix(f.avatar, "data:image/png;base64,") {
+					t.Errorf("avatar is %q, want a png", f.avatar)
+				}
+			},
+		},
+		{
+			name:    "setavatar rate limited",
+			content: "setavatar " + avatars.URL + "/avatar.png",
+			setup: func(t *testing.T, p *player, f *fakeSession) {
+				f.ratelimited = true
+			},
+			want: []string{msg("setavatar", "error")},
+		},
+		{
+			name:    "shuffle on",
+			content: "shuffle",
+			want:    []string{msg("shuffle", "on")},
+		},
+		{
+			name:    "shuffle off",
+			content: "shuffle",
+			setup: func(t *testing.T, p *player, f *fakeSession) {
+				p.setshuffle(true)
+			},
+			want: []string{msg("shuffle", "off")},
+		},
+		{
+			name:    "seek nothing",
+			content: "seek 1:30",
+			want:    []string{msg("seek", "nothing")},
+		},
+		{
+			name:    "seek",
+			content: "seek 1:30",
+			setup: func(t *testing.T, p *player, f *fakeSession) {
+				p.enqueue(song("A"))
+				locked(p, func() {
+					p.playing = 0
+					p.playingAudio = true
+				})
+			},
+			want: []string{"Playing from **01:30**"},
+			check: func(t *testing.T, p *player, f *fakeSession) {
+				locked(p, func() {
+					if !p.restart || p.resume != 90*time.Second {
+						t.Errorf("restart %t from %s, want true from 1m30s", p.restart, p.resume)
+					}
+				})
+			},
+		},
+		{
+			name:    "seek past the end",
+			content: "seek 5m",
+			setup: func(t *testing.T, p *player, f *fakeSession) {
+				p.enqueue(song("A"))
+				locked(p, func() {
+					p.playing = 0
+					p.playingAudio = true
+				})
+			},
+			want: []string{msg("seek", "toolong")},
+		},
+		{
+			name:    "remove",
+			content: "remove 2",
+			setup: func(t *testing.T, p *player, f *fakeSession) {
+				p.enqueue(song("A"))
+				p.enqueue(song("B"))
+			},
+			want: []string{"Removed **B** from the queue"},
+			check: func(t *testing.T, p *player, f *fakeSession) {
+				locked(p, func() {
+					if len(p.queue) != 1 || p.queue[0].Base.Title != "A" {
+						t.Errorf("queue has %d songs, want A", len(p.queue))
+					}
+				})
+			},
+		},
+		{
+			name:    "remove missing",
+			content: "remove 3",
+			setup: func(t *testing.T, p *player, f *fakeSession) {
+				p.enqueue(song("A"))
+			},
+			want: []string{msg("remove", "notfound")},
+		},
+		{
+			name:    "help",
+			content: "help",
+			want:    []string{msg("help", "success")},
+			check: func(t *testing.T, p *player, f *fakeSession) {
+				dm := f.messages("dm" + testUser)
+				if len(dm) != 1 || len(dm[0].embeds) == 0 {
+					t.Errorf("sent %d direct messages, want 1 with embeds", len(dm))
+				}
+			},
+		},
+		{
+			name:    "help without direct messages",
+			content: "help",
+			setup: func(t *testing.T, p *player, f *fakeSession) {
+				f.nodm = true
+			},
+			want: []string{msg("help", "error")},
+		},
+		{
+			name:    "clear",
+			content: "clear",
+			setup: func(t *testing.T, p *player, f *fakeSession) {
+				p.enqueue(song("A"))
+			},
+			want: []string{msg("clear", "clear")},
+			check: func(t *testing.T, p *player, f *fakeSession) {
+				locked(p, func() {
+					if len(p.queue) != 0 || p.queueindex != -1 {
+						t.Errorf("queue has %d songs at %d, want none", len(p.queue), p.queueindex)
+					}
+				})
+			},
+		},
+		{
+			name:    "setmessage without permission",
+			content: "setmessage skip skip Skipped!",
+			want:    []string{msg("setmessage", "permission")},
+		},
+		{
+			name:    "setmessage",
+			author:  testOwner,
+			content: "setmessage skip skip Skipped!",
+			want:    []string{"Changed the message **skip** of **skip**"},
+			check: func(t *testing.T, p *player, f *fakeSession) {
+				if got := msg("skip", "skip"); got != "Skipped!" {
+					t.Errorf("message is %q, want %q", got, "Skipped!")
+				}
+
+				if _, err := os.Stat(getconfig().MessagesPath); err != nil {
+					t.Errorf("didn't save the messages: %s", err)
+				}
+			},
+		},
+		{
+			name:    "playsample",
+			content: "playsample",
+			want: func() []string {
+				var list []string
+				for _, v := range sample {
+					list = append(list, fmt.Sprintf("Added **%s** to the queue!", v))
+				}
+				return list
+			}(),
+			check: func(t *testing.T, p *player, f *fakeSession) {
+				locked(p, func() {
+					if len(p.queue) != len(sample) {
+						t.Errorf("queue has %d songs, want %d", len(p.queue), len(sample))
+					}
+				})
+			},
+		},
+		{
+			name:    "alias without aliases",
+			content: "alias",
+			want:    []string{msg("alias", "empty")},
+		},
+		{
+			name:    "alias without permission",
+			content: "alias s skip",
+			want:    []string{msg("alias", "permission")},
+		},
+		{
+			name:    "alias",
+			author:  testOwner,
+			content: "alias s skip",
+			want:    []string{"**s** is now an alias of **skip**"},
+			check: func(t *testing.T, p *player, f *fakeSession) {
+				if findguildcommand(testGuild, "s") != findcommand("skip") {
+					t.Errorf("s isn't an alias of skip")
+				}
+			},
+		},
+		{
+			name:    "alias taken",
+			author:  testOwner,
+			content: "alias pl skip",
+			want:    []string{"**pl** is already an alias of **play**"},
+		},
+		{
+			name:    "alias removed",
+			author:  testOwner,
+			content: "alias s",
+			setup: func(t *testing.T, p *player, f *fakeSession) {
+				setguildalias(testGuild, "s", "skip")
+			},
+			want: []string{"Removed the alias **s**"},
+		},
+		{
+			name:    "leave outside of voice",
+			content: "leave",
+			want:    []string{msg("leave", "novoice")},
+		},
+		{
+			name:    "leave",
+			content: "leave",
+			setup: func(t *testing.T, p *player, f *fakeSession) {
+				p.join(f, testVoice)
+				p.setpause(true)
+				p.enqueue(song("A"))
+			},
+			// The song is skipped silently, leave has no message for it
+			check: func(t *testing.T, p *player, f *fakeSession) {
+				waitfor(t, "the player to leave", func() bool {
+					_, _, disconnected := f.voice.status()
+					return disconnected
+				})
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, p := newtestbot(t)
+			f := newfakesession(t)
+			fakevideos(t)
+
+			if tt.setup != nil {
+				tt.setup(t, p, f)
+			}
+
+			author := tt.author
+			if author == "" {
+				author = testUser
+			}
+
+			before := commandsrun()
+			b.handlemessage(f, newmessage(author, getconfig().Prefix+tt.content))
+			waitfor(t, "the command", func() bool {
+				return commandsrun() > before
+			})
+
+			if got := f.texts(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sent %q, want %q", got, tt.want)
+			}
+
+			if tt.check != nil {
+				tt.check(t, p, f)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// messageOverrides holds messages that replace the ones of the commands, keyed by the command's name and then by the message's key.
+type messageOverrides map[string]map[string]string
+
+var (
+	// guildMessages holds the messages that guilds set with the setmessage command, keyed by the guild's id
+	guildMessages   = map[string]messageOverrides{}
+	guildMessagesMu sync.RWMutex
+)
+
+// trackPlaceholders are the placeholders that replacestringwithtrackinfo replaces
+var trackPlaceholders = []string{"title", "link", "id", "description", "publishdate", "author", "duration", "name"}
+
+var placeholderRegexp = regexp.MustCompile(`{{([^{}]*)}}`)
+
+// checktemplate returns an error if cmd has no message called key, or if str has a placeholder that the message doesn't replace.
+func checktemplate(cmd *command, key, str string) error {
+	if _, ok := cmd.messages[key]; !ok {
+		return errors.New("unknown message")
+	}
+
+	for _, match := range placeholderRegexp.FindAllStringSubmatch(str, -1) {
+		known := false
+		for _, v := range cmd.placeholders[key] {
+			if v == match[1] {
+				known = true
+				break
+			}
+		}
+
+		if !known {
+			return fmt.Errorf("unknown placeholder {{%s}}", match[1])
+		}
+	}
+
+	if strings.Contains(placeholderRegexp.ReplaceAllString(str, ""), "{{") {
+		return errors.New("unclosed placeholder")
+	}
+
+	return nil
+}
+
+// validate returns an error if one of the messages doesn't belong to a command, or uses an unknown placeholder.
+func (o messageOverrides) validate() error {
+	for name, messages := range o {
+		cmd := findcommand(name)
+		if cmd == nil || cmd.alias[0] != name {
+			return fmt.Errorf("%s: unknown command", name)
+		}
+
+		for key, str := range messages {
+			err := checktemplate(cmd, key, str)
+			if err != nil {
+				return fmt.Errorf("%s.%s: %w", name, key, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// loadguildmessages loads the messages that guilds have set from config.MessagesPath.
+// Messages that aren't valid anymore, because a command changed, are dropped.
+func loadguildmessages() error {
+	body, err := ioutil.ReadFile(getconfig().MessagesPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	guildMessagesMu.Lock()
+	defer guildMessagesMu.Unlock()
+
+	err = json.Unmarshal(body, &guildMessages)
+	if err != nil {
+		return err
+	}
+
+	for id, o := range guildMessages {
+		for name, messages := range o {
+			cmd := findcommand(name)
+			for key, str := range messages {
+				if cmd == nil || cmd.alias[0] != name || checktemplate(cmd, key, str) != nil {
+					logs.with("guild", id).warnf("Dropping the message %s.%s, it isn't valid anymore", name, key)
+					delete(messages, key)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// saveguildmessages writes the messages that guilds have set to config.MessagesPath.
+func saveguildmessages() error {
+	guildMessagesMu.RLock()
+	body, err := json.MarshalIndent(guildMessages, "", "  ")
+	guildMessagesMu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(getconfig().MessagesPath, body, 0644)
+}
+
+// setguildmessage sets a message of a guild, an empty str removes it so that the default message is used again.
+func setguildmessage(guildID, name, key, str string) {
+	guildMessagesMu.Lock()
+	defer guildMessagesMu.Unlock()
+
+	if len(str) == 0 {
+		delete(guildMessages[guildID][name], key)
+		return
+	}
+
+	if guildMessages[guildID] == nil {
+		guildMessages[guildID] = messageOverrides{}
+	}
+
+	if guildMessages[guildID][name] == nil {
+		guildMessages[guildID][name] = map[string]string{}
+	}
+
+	guildMessages[guildID][name][key] = str
+}
+
+// canmanage returns true if the author of the message is allowed to manage the guild.
+func canmanage(s session, m *commandParameter) bool {
+	perms, err := s.UserChannelPermissions(m.Author.ID, m.ChannelID)
+	return err == nil && perms&discordgo.PermissionManageServer != 0
+}
+
+func cmdSetMessage(s session, m *commandParameter) {
+	if !canmanage(s, m) {
+		s.ChannelMessageSend(m.ChannelID, m.message("permission"))
+		return
+	}
+
+	cmd := findcommand(m.args.str("command"))
+	if cmd == nil {
+		s.ChannelMessageSend(m.ChannelID, strings.ReplaceAll(m.message("nocommand"), "{{command}}", m.args.str("command")))
+		return
+	}
+	name := cmd.alias[0]
+
+	// Without a key, the messages of the command are listed
+	if !m.args.has("key") {
+		keys := []string{}
+		for key := range cmd.messages {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		str := m.message("start")
+		for _, key := range keys {
+			placeholders := make([]string, len(cmd.placeholders[key]))
+			for k, v := range cmd.placeholders[key] {
+				placeholders[k] = "{{" + v + "}}"
+			}
+
+			replaces := strings.NewReplacer(
+				"{{key}}", key,
+				"{{placeholders}}", strings.Join(placeholders, " "))
+			str += replaces.Replace(m.message("loop")) + "\n"
+		}
+		str += m.message("end")
+
+		s.ChannelMessageSend(m.ChannelID, str)
+		return
+	}
+
+	key := m.args.str("key")
+	str := m.args.str("message")
+	if len(str) > 0 {
+		err := checktemplate(cmd, key, str)
+		if err != nil {
+			s.ChannelMessageSend(m.ChannelID, strings.ReplaceAll(m.message("invalid"), "{{error}}", err.Error()))
+			return
+		}
+	} else if _, ok := cmd.messages[key]; !ok {
+		s.ChannelMessageSend(m.ChannelID, strings.ReplaceAll(m.message("invalid"), "{{error}}", "unknown message"))
+		return
+	}
+
+	setguildmessage(m.GuildID, name, key, str)
+	err := saveguildmessages()
+	if err != nil {
+		m.log().err(err).errorf("Cannot save the messages of the guilds")
+	}
+
+	replaces := strings.NewReplacer(
+		"{{command}}", name,
+		"{{key}}", key)
+	if len(str) > 0 {
+		s.ChannelMessageSend(m.ChannelID, replaces.Replace(m.message("success")))
+	} else {
+		s.ChannelMessageSend(m.ChannelID, replaces.Replace(m.message("reset")))
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsServer serves /metrics, it's nil when config.MetricsAddress isn't set
+var metricsServer *http.Server
+
+// metricCounter is a prometheus counter with labels, the values are keyed by their label values.
+type metricCounter struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// newcounter returns a counter that is exposed on /metrics.
+func newcounter(name, help string, labels ...string) *metricCounter {
+	c := &metricCounter{name: name, help: help, labels: labels, values: map[string]float64{}}
+	metrics = append(metrics, c)
+	return c
+}
+
+// inc adds one to the value of the label values, they must be in the order of the counter's labels.
+func (c *metricCounter) inc(values ...string) {
+	// The label values cannot contain \x00, so it's safe to join them with it
+	key := strings.Join(values, "\x00")
+
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+func (c *metricCounter) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// A counter without labels is always exposed, even before it's increased
+	if len(c.labels) == 0 {
+		fmt.Fprintf(w, "%s %s\n", c.name, formatmetric(c.values[""]))
+		return
+	}
+
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s} %s\n", c.name, formatlabels(c.labels, strings.Split(k, "\x00")), formatmetric(c.values[k]))
+	}
+}
+
+// metricHistogram is a prometheus histogram without labels.
+type metricHistogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// newhistogram returns a histogram that is exposed on /metrics, buckets are the upper bounds in ascending order.
+func newhistogram(name, help string, buckets ...float64) *metricHistogram {
+	h := &metricHistogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	metrics = append(metrics, h)
+	return h
+}
+
+// observe adds a value to the histogram.
+func (h *metricHistogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+
+	h.mu.Lock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+
+	h.sum += v
+	h.count++
+	h.mu.Unlock()
+}
+
+// since observes how many seconds passed since start.
+func (h *metricHistogram) since(start time.Time) {
+	h.observe(time.Since(start).Seconds())
+}
+
+func (h *metricHistogram) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// The buckets of prometheus are cumulative
+	var cumulative uint64
+	for k, v := range h.buckets {
+		cumulative += h.counts[k]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatmetric(v), cumulative)
+	}
+
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatmetric(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// metricGauge is a prometheus gauge whose values are read when /metrics is scraped.
+type metricGauge struct {
+	name   string
+	help   string
+	labels []string
+	// values returns the values of the gauge keyed by their label values, joined with \x00
+	values func() map[string]float64
+}
+
+// newgauge returns a gauge that is exposed on /metrics.
+func newgauge(name, help string, values func() map[string]float64, labels ...string) *metricGauge {
+	g := &metricGauge{name: name, help: help, labels: labels, values: values}
+	metrics = append(metrics, g)
+	return g
+}
+
+func (g *metricGauge) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+
+	values := g.values()
+	if len(g.labels) == 0 {
+		fmt.Fprintf(w, "%s %s\n", g.name, formatmetric(values[""]))
+		return
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s} %s\n", g.name, formatlabels(g.labels, strings.Split(k, "\x00")), formatmetric(values[k]))
+	}
+}
+
+// formatmetric formats a value the way prometheus expects it.
+func formatmetric(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// labelReplacer escapes the label values, https://prometheus.io/docs/instrumenting/exposition_formats/
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatlabels returns the labels of a value, i.e command="play",outcome="ok".
+func formatlabels(names, values []string) string {
+	labels := make([]string, len(names))
+	for k, name := range names {
+		value := ""
+		if k < len(values) {
+			value = values[k]
+		}
+
+		labels[k] = name + `="` + labelReplacer.Replace(value) + `"`
+	}
+
+	return strings.Join(labels, ",")
+}
+
+// metrics holds every metric, in the order they are exposed
+var metrics []interface{ write(w io.Writer) }
+
+var (
+	metricTracks         = newcounter("musicbot_tracks_played_total", "Songs that started playing, by where their frames come from.", "source")
+	metricStreamResolve  = newhistogram("musicbot_stream_resolve_seconds", "How long youtube took to open the stream of a song.", 0.1, 0.25, 0.5, 1, 2.5, 5, 10)
+	metricStreamFailures = newcounter("musicbot_stream_resolve_failures_total", "Streams of songs that youtube failed to open.")
+	metricFFmpegExits    = newcounter("musicbot_ffmpeg_exits_total", "ffmpeg processes that exited, by exit code. Killed processes exit with -1.", "code")
+	metricFrames         = newcounter("musicbot_opus_frames_sent_total", "Opus frames sent to the voice connections.")
+	metricFrameSend      = newhistogram("musicbot_frame_send_seconds", "How long the voice connections took to take a frame.", 0.001, 0.005, 0.01, 0.02, 0.05, 0.1, 0.5, 2)
+	metricFrameUnderruns = newcounter("musicbot_frame_underruns_total", "Frames that arrived after the buffer of the voice connection ran empty, the audio stutters when it happens.")
+	metricCommands       = newcounter("musicbot_commands_total", "Commands that were invoked, by name and outcome. The outcome is one of ok, usage, error or panic.", "command", "outcome")
+)
+
+func init() {
+	newgauge("musicbot_ffmpeg_processes", "ffmpeg processes that are running.", func() map[string]float64 {
+		ffmpegRunningMu.Lock()
+		defer ffmpegRunningMu.Unlock()
+
+		return map[string]float64{"": float64(len(ffmpegRunning))}
+	})
+
+	newgauge("musicbot_guilds", "Guilds that the bots are in, by bot and shard.", func() map[string]float64 {
+		values := map[string]float64{}
+		for _, s := range shardstatus() {
+			values[shardkey(s)] = float64(s.Guilds)
+		}
+
+		return values
+	}, "bot", "shard")
+
+	newgauge("musicbot_shard_connected", "Shards that are connected to the gateway are 1, the others are 0.", func() map[string]float64 {
+		values := map[string]float64{}
+		for _, s := range shardstatus() {
+			values[shardkey(s)] = 0
+			if s.Connected {
+				values[shardkey(s)] = 1
+			}
+		}
+
+		return values
+	}, "bot", "shard")
+
+	newgauge("musicbot_shard_latency_seconds", "The heartbeat latency of every shard.", func() map[string]float64 {
+		values := map[string]float64{}
+		for _, s := range shardstatus() {
+			values[shardkey(s)] = s.Latency / 1000
+		}
+
+		return values
+	}, "bot", "shard")
+
+	newgauge("musicbot_players", "Players by state, connected players are in a voice channel and playing players are sending a song.", func() map[string]float64 {
+		values := map[string]float64{"created": 0, "connected": 0, "playing": 0}
+		for _, p := range allplayers() {
+			p.mu.Lock()
+			connected, playing := p.vc != nil, p.playingAudio
+			p.mu.Unlock()
+
+			values["created"]++
+			if connected {
+				values["connected"]++
+			}
+
+			if playing {
+				values["playing"]++
+			}
+		}
+
+		return values
+	}, "state")
+
+	newgauge("musicbot_queue_length", "Songs in the queue of each guild, by bot.", func() map[string]float64 {
+		values := map[string]float64{}
+		for _, p := range allplayers() {
+			p.mu.Lock()
+			values[strconv.Itoa(p.bot.id)+"\x00"+p.guildID] = float64(len(p.queue))
+			p.mu.Unlock()
+		}
+
+		return values
+	}, "bot", "guild")
+}
+
+// shardkey returns the label values of a shard's gauges.
+func shardkey(s shardStatus) string {
+	return strconv.Itoa(s.Bot) + "\x00" + strconv.Itoa(s.ID)
+}
+
+// startmetrics serves /metrics on config.MetricsAddress in the background.
+func startmetrics() error {
+	ln, err := net.Listen("tcp", getconfig().MetricsAddress)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+
+	metricsServer = &http.Server{
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		err := metricsServer.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			logs.err(err).errorf("The metrics stopped")
+		}
+	}()
+
+	return nil
+}
+
+// metricsHandler writes every metric in the text format of prometheus.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
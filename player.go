@@ -0,0 +1,380 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"gopkg.in/hraban/opus.v2"
+)
+
+const (
+	loopOff   = iota // No cmdLoop(
+	loopSong         // cmdLoop( current song
+	loopQueue        // cmdLoop( current queue
+)
+
+// player holds the queue and the playback of a single guild.
+type player struct {
+	guildID string
+	// bot is the bot that the player belongs to
+	bot *bot
+
+	// mu guards the state of the player, the commands, the api and the handlers change it while run() plays the songs.
+	// run() only holds it between the frames, never while it waits for youtube, ffmpeg or the voice connection.
+	// encoder, sendtimer and streaming are only used by run(), and prefetch has a lock of its own.
+	mu sync.Mutex
+
+	// session is the session that the player joined the voice channel with
+	session session
+	vc      voiceConnection
+	// channelID is the voice channel that the player is in. discordgo changes vc.ChannelID
+	// before the handlers get the VoiceStateUpdate, so moves are noticed by comparing with this.
+	channelID string
+
+	queue      []*videoInfo
+	queueindex int // This is the original queue index
+	// playing is the index of the song that is being sent, -1 if none. Editing the queue keeps it pointing at the same song,
+	// and the song stops once it's not queueindex anymore.
+	playing int
+
+	loop    int
+	shuffle bool
+	pause   bool
+
+	// shufflenext is the song that has been picked to play after the current one in shuffle mode,
+	// it's picked once so that the prefetched song is the one that plays next. -1 if none was picked yet.
+	shufflenext int
+
+	// The perception of loudness from the intensity of the sound waves.
+	volume float64
+
+	// playingAudio is used to determine if currently a song is playing or not. It starts from run()
+	playingAudio bool
+
+	// position is how much of the current song has been sent to the voice connection.
+	position time.Duration
+
+	// audio holds the encoder settings of the guild, encoder is built from them.
+	audio   AudioConfig
+	encoder *opus.Encoder
+	// bitrate is the bitrate in kbps that the encoder is set to by applybitrate, 0 if it's kept.
+	bitrate int
+	// nextaudio holds the audio settings that the config has been reloaded with, nil if none. The frames of
+	// the current song are sized for the old settings, so they are applied before the next song.
+	nextaudio *AudioConfig
+
+	prefetch prefetch
+
+	// idlesince is when the queue ended, the player leaves once it has been idle for config.IdleTimeout.
+	idlesince time.Time
+	// alone is set while nobody is listening in the voice channel, alonetimer leaves the voice channel
+	// once the bot has been alone for config.AloneTimeout. autopaused is set if the song was paused because of it.
+	alone      bool
+	alonetimer *time.Timer
+	autopaused bool
+
+	// interrupted is set when the voice connection died while a song was playing,
+	// the song is resumed from resume once the player reconnected.
+	interrupted bool
+	resume      time.Duration
+	// recovering is 1 while the player is reconnecting, it's only used atomically.
+	recovering int32
+	// sendtimer is used to notice when the voice connection stops taking frames.
+	sendtimer *time.Timer
+
+	// restart stops the current song without picking the next one, run() then plays it again from resume.
+	restart bool
+	// textchannel is the channel that the last command of the guild was used in, the shutdown is announced there.
+	textchannel string
+	// stopping makes run() return once the song is closed, and it closes stopped then. wake cuts the wait of
+	// run() between two songs short, so that it notices stopping right away.
+	stopping bool
+	stopped  chan struct{}
+	wake     chan struct{}
+
+	// streaming is set while frames are sent one after the other, so that the voice connection running out of frames
+	// is counted as an underrun. It's unset at the start of every song and while the song is paused.
+	streaming bool
+}
+
+// getplayer returns the bot's player of a guild, the player is created the first time the guild uses the bot.
+func (b *bot) getplayer(guildID string) (*player, error) {
+	b.playersMu.Lock()
+	defer b.playersMu.Unlock()
+
+	p, ok := b.players[guildID]
+	if ok {
+		return p, nil
+	}
+
+	p = &player{
+		guildID:     guildID,
+		bot:         b,
+		queueindex:  -1,
+		playing:     -1,
+		shufflenext: -1,
+		volume:      1,
+		audio:       getconfig().guildAudio(guildID),
+		stopped:     make(chan struct{}),
+		wake:        make(chan struct{}, 1),
+	}
+
+	// Encoder is used to encode the Output file to discord's own DCA format
+	var err error
+	p.encoder, err = newencoder(p.audio)
+	if err != nil {
+		return nil, err
+	}
+
+	b.players[guildID] = p
+	go p.run()
+
+	return p, nil
+}
+
+// newencoder returns an opus encoder that uses the settings of audio.
+func newencoder(audio AudioConfig) (*opus.Encoder, error) {
+	enc, err := opus.NewEncoder(audioFrameRate, audio.Channels, audioApplications[audio.Application])
+	if err != nil {
+		return nil, err
+	}
+
+	err = enc.SetBitrate(audio.Bitrate * 1000)
+	if err != nil {
+		return nil, err
+	}
+
+	return enc, nil
+}
+
+// applyaudio rebuilds the encoder with the audio settings of a reloaded config. The prefetched song
+// has been opened with the old settings, so it's opened again.
+func (p *player) applyaudio() {
+	p.mu.Lock()
+	audio := p.nextaudio
+	p.nextaudio = nil
+	p.mu.Unlock()
+
+	if audio == nil {
+		return
+	}
+
+	enc, err := newencoder(*audio)
+	if err != nil {
+		p.log().err(err).errorf("Cannot apply the audio settings of the reloaded config")
+		return
+	}
+
+	p.discardprefetch()
+	p.mu.Lock()
+	p.audio = *audio
+	p.bitrate = 0
+	p.mu.Unlock()
+	p.encoder = enc
+
+	if p.session != nil && len(p.channelID) > 0 {
+		ch, err := p.session.state().Channel(p.channelID)
+		if err == nil {
+			p.matchbitrate(ch)
+		}
+	}
+}
+
+// run manages the newly-added songs, whenever a new song is added it calls
+// play() to stream it to discord, and then closes it for another song to be played.
+// If there are any problems with the queue, most likely it's from this function alone.
+func (p *player) run() {
+	for {
+		p.mu.Lock()
+		if p.stopping {
+			p.mu.Unlock()
+			close(p.stopped)
+			return
+		}
+
+		// Songs are only played inside of a voice channel, otherwise they would be skipped right away
+		if p.vc != nil && len(p.queue) > p.queueindex && p.queueindex >= 0 {
+			p.idlesince = time.Time{}
+
+			p.setpauselocked(false)
+
+			qi := p.queueindex
+			vid := p.queue[qi]
+			p.playingAudio = true
+			p.mu.Unlock()
+
+			p.applyaudio()
+			p.applybitrate()
+
+			// The next song might have been opened while the last one was playing
+			t := p.takeprefetch(qi, vid)
+			if t == nil {
+				var err error
+				t, err = p.opentrack(vid)
+				if err != nil {
+					p.log().with("track", trackid(vid)).err(err).errorf("Cannot play %s, removing it from the queue", vid.Base.Title)
+					p.dropsong(qi, vid)
+					continue
+				}
+			}
+
+			p.mu.Lock()
+			t.start = p.resume
+			p.resume = 0
+			p.mu.Unlock()
+
+			p.emitsong(eventTrackStarted, vid, qi, t.start)
+			metricTracks.inc(t.source())
+
+			t.play()
+			t.Close()
+
+			p.mu.Lock()
+			position := p.position
+			interrupted := p.interrupted
+			p.interrupted = false
+			restart := p.restart
+			p.restart = false
+			p.mu.Unlock()
+
+			p.emitsong(eventTrackEnded, vid, qi, position)
+
+			if interrupted {
+				p.recover()
+			}
+
+			// The song was seeked, it starts again right away
+			if restart {
+				continue
+			}
+		} else if p.vc != nil {
+			p.mu.Unlock()
+			p.checkidle()
+		} else {
+			p.mu.Unlock()
+		}
+
+		select {
+		case <-time.After(time.Second):
+		case <-p.wake:
+		}
+	}
+}
+
+// quit makes run() return once the song is closed, and leaves the voice channel.
+func (p *player) quit() {
+	p.mu.Lock()
+	p.stopping = true
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+
+	p.leave()
+}
+
+// close stops the player, it returns once run() returned.
+func (p *player) close() {
+	p.quit()
+	<-p.stopped
+}
+
+// dropsong removes a song that cannot be opened from the queue, otherwise looping would open it again right away.
+// The next song takes its index, and the queue starts over when it was the last song and the queue is looped.
+func (p *player) dropsong(qi int, vid *videoInfo) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.playingAudio = false
+
+	// The queue might have been changed while the song was being opened
+	if qi < len(p.queue) && p.queue[qi] == vid {
+		p.removesonglocked(qi)
+	}
+
+	if p.loop == loopQueue && len(p.queue) > 0 && p.queueindex >= len(p.queue) {
+		p.queueindex = 0
+	}
+}
+
+// setqueueindex sets the song that plays, p.mu must be held.
+func (p *player) setqueueindex(v int) {
+	if len(p.queue) >= v {
+		p.queueindex = v
+	}
+}
+
+// finishsong is called whenever a song stops playing, it picks the next song
+// depending on the loop and shuffle modes.
+func (p *player) finishsong() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.vc != nil {
+		p.vc.Speaking(false)
+	}
+
+	p.playingAudio = false
+
+	qi := p.playing
+	p.playing = -1
+
+	// If the user didn't skip the song, and it wasn't cut off by the voice connection or seeked
+	if qi == p.queueindex && !p.interrupted && !p.restart {
+		p.setqueueindex(p.nextqueueindex(qi))
+		p.shufflenext = -1
+	}
+}
+
+// nextqueueindex returns the index of the song that plays after qi, depending on the loop and shuffle modes.
+// If the queue is over, it returns len(queue). p.mu must be held.
+func (p *player) nextqueueindex(qi int) int {
+	// If loop is set to loop song then replay it
+	if p.loop == loopSong {
+		return qi
+	}
+
+	// If shuffle is off and loop is not set to loop song
+	if !p.shuffle {
+		// If the amount of songs is equal to the next song index, i.e
+		// amount of songs: 5, current song: 4, the next index would be 0. starting over again.
+		if qi+1 == len(p.queue) && p.loop == loopQueue {
+			return 0
+		}
+
+		// If the amount of songs exceeds the current song index, i.e
+		// amount of songs: 5, current song: 3, the next index would be 4
+		if len(p.queue) > qi {
+			return qi + 1
+		}
+
+		return qi
+	}
+
+	if p.shufflenext >= 0 && p.shufflenext < len(p.queue) && p.shufflenext != qi {
+		return p.shufflenext
+	}
+
+	// Array to hold all the songs' index that are left
+	arr := []int{}
+	for i := 0; i < len(p.queue); i++ {
+		if i == qi {
+			continue
+		}
+
+		arr = append(arr, i)
+	}
+
+	// If there are more than 1 song in the array
+	if len(arr) > 1 {
+		// Set the next index to a random index that is equal to len(arr)-1
+		// this will give us a random song index that is not the song that has been played before.
+		p.shufflenext = arr[rand.Intn(len(arr)-1)]
+		return p.shufflenext
+	}
+
+	return qi
+}
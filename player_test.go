@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	ytdl "github.com/kkdai/youtube/v2"
+)
+
+func TestFinishSong(t *testing.T) {
+	// anysong is used for want when shuffle picks any song but the one that played
+	const anysong = -2
+
+	tests := []struct {
+		name        string
+		songs       int
+		loop        int
+		shuffle     bool
+		shufflenext int
+		// playing is the song that stopped, and queueindex the song that the queue was at by then
+		playing     int
+		queueindex  int
+		interrupted bool
+		restart     bool
+		want        int
+	}{
+		{name: "next song", songs: 3, playing: 0, queueindex: 0, want: 1},
+		{name: "queue over", songs: 3, playing: 2, queueindex: 2, want: 3},
+		{name: "loop song", songs: 3, loop: loopSong, playing: 1, queueindex: 1, want: 1},
+		{name: "loop queue", songs: 3, loop: loopQueue, playing: 1, queueindex: 1, want: 2},
+		{name: "loop queue wraps around", songs: 3, loop: loopQueue, playing: 2, queueindex: 2, want: 0},
+		{name: "skipped", songs: 3, playing: 0, queueindex: 2, want: 2},
+		{name: "cleared", songs: 0, playing: 0, queueindex: -1, want: -1},
+		{name: "interrupted", songs: 3, playing: 1, queueindex: 1, interrupted: true, want: 1},
+		{name: "seeked", songs: 3, playing: 1, queueindex: 1, restart: true, want: 1},
+		{name: "shuffle", songs: 5, shuffle: true, shufflenext: -1, playing: 1, queueindex: 1, want: anysong},
+		{name: "shuffle picked", songs: 5, shuffle: true, shufflenext: 3, playing: 1, queueindex: 1, want: 3},
+		{name: "shuffle picked the same song", songs: 5, shuffle: true, shufflenext: 1, playing: 1, queueindex: 1, want: anysong},
+		{name: "shuffle picked a removed song", songs: 3, shuffle: true, shufflenext: 4, playing: 1, queueindex: 1, want: anysong},
+		{name: "shuffle loop song", songs: 5, shuffle: true, loop: loopSong, shufflenext: 3, playing: 1, queueindex: 1, want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vc := newfakevoice(testVoice)
+			vc.speaking = true
+
+			p := &player{
+				vc:           vc,
+				loop:         tt.loop,
+				shuffle:      tt.shuffle,
+				shufflenext:  tt.shufflenext,
+				playing:      tt.playing,
+				queueindex:   tt.queueindex,
+				interrupted:  tt.interrupted,
+				restart:      tt.restart,
+				playingAudio: true,
+			}
+
+			for i := 0; i < tt.songs; i++ {
+				p.queue = append(p.queue, song(fmt.Sprint(i)))
+			}
+
+			p.finishsong()
+
+			if tt.want == anysong {
+				if p.queueindex == tt.playing || p.queueindex < 0 || p.queueindex >= tt.songs {
+					t.Errorf("queueindex is %d, want another song than %d", p.queueindex, tt.playing)
+				}
+			} else if p.queueindex != tt.want {
+				t.Errorf("queueindex is %d, want %d", p.queueindex, tt.want)
+			}
+
+			// The song that has been picked is only used once
+			if p.queueindex != tt.queueindex && p.shufflenext != -1 {
+				t.Errorf("shufflenext is %d, want -1", p.shufflenext)
+			}
+
+			if p.playing != -1 || p.playingAudio || vc.speaking {
+				t.Errorf("the song didn't stop: playing %d, playingAudio %t, speaking %t", p.playing, p.playingAudio, vc.speaking)
+			}
+		})
+	}
+}
+
+func TestSkip(t *testing.T) {
+	tests := []struct {
+		name       string
+		songs      int
+		queueindex int
+		want       int
+		skipped    bool
+	}{
+		{name: "empty queue", songs: 0, queueindex: -1, want: -1},
+		{name: "next song", songs: 3, queueindex: 0, want: 1, skipped: true},
+		{name: "last song", songs: 3, queueindex: 2, want: 3, skipped: true},
+		{name: "queue over", songs: 3, queueindex: 3, want: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &player{queueindex: tt.queueindex, pause: true}
+			for i := 0; i < tt.songs; i++ {
+				p.queue = append(p.queue, song(fmt.Sprint(i)))
+			}
+
+			skipped := p.skip()
+			if skipped != tt.skipped || p.queueindex != tt.want {
+				t.Errorf("skipped %t to %d, want %t to %d", skipped, p.queueindex, tt.skipped, tt.want)
+			}
+
+			if p.pause {
+				t.Errorf("still paused")
+			}
+		})
+	}
+}
+
+func TestPrefetchFailure(t *testing.T) {
+	newtestbot(t)
+	editconfig(func(c *Config) { c.PrefetchSeconds = 5 })
+
+	missing := song("B")
+	missing.File = "missing.dca"
+
+	p := &player{queue: []*videoInfo{song("A"), missing}, queueindex: 0, playing: 0, shufflenext: -1, position: 178 * time.Second}
+
+	opening := func() bool {
+		p.prefetch.Lock()
+		defer p.prefetch.Unlock()
+
+		return p.prefetch.opening
+	}
+
+	p.checkprefetch()
+	waitfor(t, "the prefetch to fail", func() bool {
+		return !opening()
+	})
+
+	// The song that cannot be opened is remembered, so that it isn't opened again for every frame
+	p.prefetch.Lock()
+	failed := p.prefetch.vid == missing && p.prefetch.index == 1
+	p.prefetch.Unlock()
+	if !failed {
+		t.Errorf("forgot the song that couldn't be opened")
+	}
+
+	p.checkprefetch()
+	if opening() {
+		t.Errorf("opening the song again")
+	}
+
+	if p.takeprefetch(1, missing) != nil {
+		t.Errorf("took a track that couldn't be opened")
+	}
+}
+
+func TestMatchBitrate(t *testing.T) {
+	newtestbot(t)
+
+	audio := getconfig().Audio
+	audio.MaxBitrate = 96
+	enc, err := newencoder(audio)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &player{audio: audio, encoder: enc}
+
+	// The encoder isn't changed until run() applies the bitrate
+	p.matchbitrate(&discordgo.Channel{Bitrate: 128000})
+	if p.audio.Bitrate != 64 || p.bitrate != 96 {
+		t.Fatalf("bitrate is %d, wants %d, want 64 and 96", p.audio.Bitrate, p.bitrate)
+	}
+
+	p.applybitrate()
+	if p.audio.Bitrate != 96 || p.bitrate != 0 {
+		t.Errorf("bitrate is %d, wants %d, want 96 and 0", p.audio.Bitrate, p.bitrate)
+	}
+
+	// The channel's bitrate is the one that is used already
+	p.matchbitrate(&discordgo.Channel{Bitrate: 96000})
+	if p.bitrate != 0 {
+		t.Errorf("wants the bitrate %d, want 0", p.bitrate)
+	}
+}
+
+func TestStop(t *testing.T) {
+	_, p := newtestbot(t)
+	f := newfakesession(t)
+
+	writedca(t, "long", "Long", 3000)
+	p.enqueue(&videoInfo{
+		Base: &ytdl.Video{ID: "long", Title: "Long"},
+		Name: "Stop",
+		File: filepath.Join(getconfig().DcaPath, "long"+dcaExtension),
+	})
+
+	locked(p, func() { p.textchannel = testText })
+	err := p.join(f, testVoice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitfor(t, "the song to start", func() bool {
+		_, frames, _ := f.voice.status()
+		return frames > 0
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p.stop(ctx)
+
+	select {
+	case <-p.stopped:
+	default:
+		t.Fatal("run() is still running")
+	}
+
+	if texts := f.texts(); len(texts) != 1 || texts[0] != msg("leave", "shutdown") {
+		t.Errorf("sent %q, want the shutdown message", texts)
+	}
+
+	if _, _, disconnected := f.voice.status(); !disconnected {
+		t.Errorf("still in the voice channel")
+	}
+}
+
+func TestOpenFailure(t *testing.T) {
+	_, p := newtestbot(t)
+	f := newfakesession(t)
+
+	writedca(t, "short", "Short", 5)
+	missing := song("Missing")
+	missing.File = "missing.dca"
+	short := &videoInfo{
+		Base: &ytdl.Video{ID: "short", Title: "Short"},
+		Name: "Open",
+		File: filepath.Join(getconfig().DcaPath, "short"+dcaExtension),
+	}
+
+	// The song that cannot be opened would be opened again and again if it stayed in the looped queue
+	p.setloop(loopSong)
+	p.enqueue(missing)
+	p.enqueue(short)
+
+	err := p.join(f, testVoice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitfor(t, "the next song to start", func() bool {
+		_, frames, _ := f.voice.status()
+		return frames > 0
+	})
+
+	locked(p, func() {
+		if len(p.queue) != 1 || p.queue[0] != short || p.queueindex != 0 {
+			t.Errorf("the queue is %v at %d, want only the song that can be played", p.queue, p.queueindex)
+		}
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// prefetch holds the song that plays after the current one. It's opened a few seconds
+// before the current song ends, so that the next song starts without waiting for youtube and ffmpeg.
+type prefetch struct {
+	sync.Mutex
+	// index and vid are the queue entry that has been prefetched. They are kept when it cannot be opened,
+	// so that it isn't opened again for every frame, run() tries once more when the song comes up.
+	index int
+	vid   *videoInfo
+	track *track
+	// opening is true while the track is being opened.
+	opening bool
+}
+
+// checkprefetch is called for every frame of the song that is playing, and starts opening the next
+// song once the current one has less than config.PrefetchSeconds left. A prefetched song that
+// isn't the next one anymore, because the queue or the loop and shuffle modes changed, is discarded.
+func (p *player) checkprefetch() {
+	if getconfig().PrefetchSeconds <= 0 {
+		return
+	}
+
+	p.mu.Lock()
+	qi := p.playing
+	if qi < 0 || qi >= len(p.queue) {
+		p.mu.Unlock()
+		return
+	}
+
+	cur := p.queue[qi]
+	if cur.Base == nil || cur.Base.Duration <= 0 || cur.Base.Duration-p.position > time.Duration(getconfig().PrefetchSeconds)*time.Second {
+		p.mu.Unlock()
+		return
+	}
+
+	next := p.nextqueueindex(qi)
+	var vid *videoInfo
+	if next != qi && next >= 0 && next < len(p.queue) {
+		vid = p.queue[next]
+	}
+	p.mu.Unlock()
+
+	if vid == nil {
+		p.discardprefetch()
+		return
+	}
+
+	p.prefetch.Lock()
+	defer p.prefetch.Unlock()
+
+	if p.prefetch.vid == vid && p.prefetch.index == next {
+		return
+	}
+
+	// The queue changed since the song was prefetched
+	if p.prefetch.track != nil {
+		p.prefetch.track.Close()
+		p.prefetch.track = nil
+	}
+
+	p.prefetch.index = next
+	p.prefetch.vid = vid
+	if p.prefetch.opening {
+		// the goroutine discards what it opened once it notices that vid changed
+		return
+	}
+
+	p.prefetch.opening = true
+	go func() {
+		t, err := p.opentrack(vid)
+
+		p.prefetch.Lock()
+		defer p.prefetch.Unlock()
+
+		p.prefetch.opening = false
+		if err != nil {
+			p.log().with("track", trackid(vid)).err(err).warnf("Cannot prefetch %s", vid.Base.Title)
+			return
+		}
+
+		if p.prefetch.vid != vid {
+			t.Close()
+			return
+		}
+
+		p.prefetch.track = t
+	}()
+}
+
+// takeprefetch returns the prefetched track if it's the song at index, otherwise it
+// discards the prefetched track and returns nil.
+func (p *player) takeprefetch(index int, vid *videoInfo) *track {
+	p.prefetch.Lock()
+	defer p.prefetch.Unlock()
+
+	t := p.prefetch.track
+	if t != nil && (p.prefetch.index != index || p.prefetch.vid != vid) {
+		t.Close()
+		t = nil
+	}
+
+	p.prefetch.track = nil
+	p.prefetch.vid = nil
+	return t
+}
+
+// discardprefetch closes the prefetched track, if there is one.
+func (p *player) discardprefetch() {
+	p.prefetch.Lock()
+	defer p.prefetch.Unlock()
+
+	if p.prefetch.track != nil {
+		p.prefetch.track.Close()
+		p.prefetch.track = nil
+	}
+
+	p.prefetch.vid = nil
+}
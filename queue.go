@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// The operations of the player, they are shared by the commands and the api. They hold the player's lock themselves.
+
+var (
+	errNothingPlaying = errors.New("nothing is playing")
+	errNoSong         = errors.New("there is no song at that index")
+	errSeekEnd        = errors.New("the song is shorter than that")
+)
+
+// loopModes maps the names of the loop modes to the modes
+var loopModes = map[string]int{
+	"off":      loopOff,
+	"song":     loopSong,
+	"queue":    loopQueue,
+	"playlist": loopQueue,
+}
+
+// loopname returns the name of a loop mode.
+func loopname(mode int) string {
+	switch mode {
+	case loopSong:
+		return "song"
+	case loopQueue:
+		return "queue"
+	}
+
+	return "off"
+}
+
+// enqueue appends vid to the queue and returns its index. If the queue was empty, the song starts playing
+// once the player is in a voice channel.
+func (p *player) enqueue(vid *videoInfo) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	oldlen := len(p.queue)
+	p.queue = append(p.queue, vid)
+
+	// If we have a clear queue, set queueindex to 0 to initiate the first song.
+	if p.queueindex < 0 && oldlen == 0 {
+		p.setqueueindex(0)
+	}
+
+	p.emitqueue()
+	return oldlen
+}
+
+// skip stops the current song and plays the next one in the queue. It returns false if there is nothing to skip.
+func (p *player) skip() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.setpauselocked(false)
+	if p.queueindex < 0 {
+		return false
+	}
+
+	i := p.queueindex + 1
+	if i > len(p.queue) {
+		return false
+	}
+
+	p.setqueueindex(i)
+	return true
+}
+
+// setvolume sets the volume from 0 to 100.
+func (p *player) setvolume(vol int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.volume = float64(vol) / 100
+	p.emit(eventVolumeChanged, vol)
+}
+
+// setpause pauses or resumes the current song, it returns false if the song already was.
+func (p *player) setpause(pause bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.setpauselocked(pause)
+}
+
+// setpauselocked is setpause for the callers that hold p.mu.
+func (p *player) setpauselocked(pause bool) bool {
+	if p.pause == pause {
+		return false
+	}
+
+	p.pause = pause
+	if pause {
+		p.emit(eventPaused, nil)
+	} else {
+		p.emit(eventResumed, nil)
+	}
+
+	return true
+}
+
+// setloop sets the loop mode, and drops the song that has been picked to play next.
+func (p *player) setloop(mode int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.loop = mode
+	p.shufflenext = -1
+	p.emit(eventLoopChanged, loopname(mode))
+}
+
+// setshuffle turns shuffle on or off, and drops the song that has been picked to play next.
+func (p *player) setshuffle(shuffle bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.shuffle = shuffle
+	p.shufflenext = -1
+	p.emit(eventShuffleChanged, shuffle)
+}
+
+// clearqueue removes every song from the queue, the current song stops.
+func (p *player) clearqueue() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.queue = []*videoInfo{}
+	p.setqueueindex(-1)
+	p.discardprefetch()
+	p.emitqueue()
+}
+
+// removesong removes the song at index from the queue and returns it. If it's the current song, it stops and the next one plays.
+func (p *player) removesong(index int) (*videoInfo, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.removesonglocked(index)
+}
+
+// removesonglocked is removesong for the callers that hold p.mu.
+func (p *player) removesonglocked(index int) (*videoInfo, error) {
+	if index < 0 || index >= len(p.queue) {
+		return nil, errNoSong
+	}
+
+	vid := p.queue[index]
+
+	queue := make([]*videoInfo, 0, len(p.queue)-1)
+	queue = append(queue, p.queue[:index]...)
+	p.queue = append(queue, p.queue[index+1:]...)
+
+	// queueindex keeps pointing at the same song, or at the one after the removed song
+	if index < p.queueindex {
+		p.queueindex--
+	}
+
+	if index < p.playing {
+		p.playing--
+	} else if index == p.playing {
+		// The song stops since queueindex isn't the song that is playing anymore
+		p.playing = -1
+	}
+
+	p.shufflenext = -1
+	p.discardprefetch()
+	p.emitqueue()
+	return vid, nil
+}
+
+// movesong moves the song at from to the index to, the current song keeps playing.
+func (p *player) movesong(from, to int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if from < 0 || from >= len(p.queue) || to < 0 || to >= len(p.queue) {
+		return errNoSong
+	}
+
+	queue := make([]*videoInfo, 0, len(p.queue))
+	for k, v := range p.queue {
+		if k != from {
+			queue = append(queue, v)
+		}
+	}
+
+	queue = append(queue[:to], append([]*videoInfo{p.queue[from]}, queue[to:]...)...)
+
+	// moved returns the new index of the song that was at k
+	moved := func(k int) int {
+		switch {
+		case k == from:
+			return to
+		case from < to && k > from && k <= to:
+			return k - 1
+		case to < from && k >= to && k < from:
+			return k + 1
+		}
+
+		return k
+	}
+
+	p.queue = queue
+	if p.queueindex >= 0 && p.queueindex < len(p.queue) {
+		p.queueindex = moved(p.queueindex)
+	}
+
+	if p.playing >= 0 {
+		p.playing = moved(p.playing)
+	}
+
+	p.shufflenext = -1
+	p.discardprefetch()
+	p.emitqueue()
+	return nil
+}
+
+// seek plays the current song from position.
+func (p *player) seek(position time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	qi := p.playing
+	if !p.playingAudio || qi < 0 || qi >= len(p.queue) {
+		return errNothingPlaying
+	}
+
+	if d := p.queue[qi].Base.Duration; d > 0 && position >= d {
+		return errSeekEnd
+	}
+
+	p.resume = position
+	p.restart = true
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"os"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// reloadMu keeps two reloads from running at once, editors often write the config file more than once
+var reloadMu sync.Mutex
+
+// watchconfig reloads the config whenever its file changes.
+func watchconfig() {
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		logs.with("file", e.Name).debugf("The config changed")
+		reloadconfig()
+	})
+
+	viper.WatchConfig()
+}
+
+// reloadconfig applies the config file while the bot runs. An invalid config is logged and the previous one keeps running.
+// The prefix, messages, limits and languages apply right away, the status is updated, the players get the new audio
+// settings before their next song, and the session reconnects when the token changed.
+func reloadconfig() {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if isshuttingdown() {
+		return
+	}
+
+	// viper keeps the previous values when the file cannot be parsed and doesn't report it,
+	// so the file is read again to know about it
+	err := viper.ReadInConfig()
+	if err != nil {
+		logs.err(err).errorf("Cannot read the config, the previous one is kept")
+		return
+	}
+
+	c := &Config{}
+	err = viper.Unmarshal(c)
+	if err != nil {
+		logs.err(err).errorf("Cannot unmarshal the config, the previous one is kept")
+		return
+	}
+
+	err = c.validate()
+	if err != nil {
+		logs.err(err).errorf("Invalid config, the previous one is kept")
+		return
+	}
+
+	cats, err := loadcatalogs(c.LocalesPath)
+	if err != nil {
+		logs.err(err).errorf("Cannot load the message catalogs, the previous config is kept")
+		return
+	}
+
+	err = c.checklanguages(cats)
+	if err != nil {
+		logs.err(err).errorf("Invalid config, the previous one is kept")
+		return
+	}
+
+	if c.DcaRecord {
+		err = os.MkdirAll(c.DcaPath, 0755)
+		if err != nil {
+			logs.err(err).errorf("Cannot create the DCA directory, the previous config is kept")
+			return
+		}
+	}
+
+	old := getconfig()
+	setconfig(c, cats)
+
+	setuplogging()
+
+	// These are only used while the bot starts
+	for _, v := range []struct {
+		key     string
+		changed bool
+	}{
+		{"youtubeKey", old.YoutubeKey != c.YoutubeKey},
+		{"metricsAddress", old.MetricsAddress != c.MetricsAddress},
+		{"shards", old.Shards != c.Shards},
+		{"api.address", old.API.Address != c.API.Address},
+		{"api.dashboard.enabled", old.API.Dashboard.Enabled != c.API.Dashboard.Enabled},
+	} {
+		if v.changed {
+			logs.with("key", v.key).warnf("The setting changed, it only applies once the bot restarts")
+		}
+	}
+
+	// Bots cannot be added or removed while the bot runs, but their tokens can change
+	oldtokens, tokens := old.tokens(), c.tokens()
+	if len(oldtokens) != len(tokens) {
+		logs.with("key", "botTokens").warnf("The setting changed, it only applies once the bot restarts")
+	} else {
+		for id, token := range tokens {
+			if token == oldtokens[id] {
+				continue
+			}
+
+			err = bots[id].reconnect(token)
+			if err != nil {
+				logs.with("bot", id).err(err).errorf("Cannot connect with the new token, the previous one is kept")
+			}
+		}
+	}
+
+	if !old.API.Dashboard.DevLogin {
+		warndevlogin(c.API.Dashboard)
+	}
+
+	if old.Status != c.Status {
+		// An empty status clears it
+		setstatus(c.Status)
+	}
+
+	for _, p := range allplayers() {
+		audio := c.guildAudio(p.guildID)
+		if audio != old.guildAudio(p.guildID) {
+			p.mu.Lock()
+			p.nextaudio = &audio
+			p.mu.Unlock()
+		}
+	}
+
+	logs.infof("Reloaded the config")
+}
+
+// settoken sets the token that every shard of the bot identifies with.
+func (b *bot) settoken(token string) {
+	for _, s := range b.shards {
+		s.Token = token
+		s.Identify.Token = token
+	}
+}
+
+// reconnect closes the sessions of the bot's shards and opens them again with token. The players leave their voice channels first and
+// join them again afterwards, the songs resume where they stopped. If the session cannot be opened with token,
+// it's opened again with the previous token.
+func (b *bot) reconnect(token string) error {
+	b.playersMu.Lock()
+	channels := map[*player]string{}
+	for _, p := range b.players {
+		p.mu.Lock()
+		if p.vc != nil {
+			channels[p] = p.channelID
+		}
+		p.mu.Unlock()
+	}
+	b.playersMu.Unlock()
+
+	for p := range channels {
+		// The song stops without the next one being picked, and plays from resume once the player joined again
+		p.mu.Lock()
+		if p.playingAudio {
+			p.resume = p.position
+			p.restart = true
+		}
+		p.mu.Unlock()
+
+		p.leave()
+	}
+
+	logs.with("bot", b.id).infof("Reconnecting with the new token")
+	b.close()
+
+	previous := b.shards[0].Token
+	b.settoken("Bot " + token)
+
+	err := b.open()
+	if err != nil {
+		b.close()
+		b.settoken(previous)
+
+		openerr := b.open()
+		if openerr != nil {
+			logs.with("bot", b.id).err(openerr).errorf("Cannot open the sessions again with the previous token")
+		}
+	}
+
+	for p, channelID := range channels {
+		joinerr := p.join(discordSession{b.guildsession(p.guildID)}, channelID)
+		if joinerr != nil {
+			p.log().err(joinerr).errorf("Cannot join the voice channel again")
+			p.mu.Lock()
+			p.resume = 0
+			p.mu.Unlock()
+			p.leave()
+		}
+	}
+
+	return err
+}
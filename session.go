@@ -0,0 +1,85 @@
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+)
+
+// messenger sends messages and edits the bot's account, *discordgo.Session implements it.
+type messenger interface {
+	ChannelMessageSend(channelID string, content string, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ChannelMessageSendEmbed(channelID string, embed *discordgo.MessageEmbed, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ChannelMessageSendEmbeds(channelID string, embeds []*discordgo.MessageEmbed, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	UserChannelCreate(recipientID string, options ...discordgo.RequestOption) (*discordgo.Channel, error)
+	UserChannelPermissions(userID, channelID string, options ...discordgo.RequestOption) (int64, error)
+	UserUpdate(username, avatar string, options ...discordgo.RequestOption) (*discordgo.User, error)
+}
+
+// guildState looks up the guilds, channels and members that the bot knows about, *discordgo.State implements it.
+type guildState interface {
+	Guild(guildID string) (*discordgo.Guild, error)
+	Channel(channelID string) (*discordgo.Channel, error)
+	Member(guildID, userID string) (*discordgo.Member, error)
+	UserChannelPermissions(userID, channelID string) (int64, error)
+}
+
+// voiceConnection sends the opus frames of a player to its voice channel.
+type voiceConnection interface {
+	ChangeChannel(channelID string, mute, deaf bool) error
+	Speaking(speaking bool) error
+	Disconnect() error
+	Close()
+	// ready returns true if the voice connection is connected and can send frames
+	ready() bool
+	// opus returns the channel that the frames are sent to
+	opus() chan []byte
+}
+
+// session is what the commands and the players use of discord. discordSession implements it with discordgo,
+// so that the commands can be tested without discord.
+type session interface {
+	messenger
+	// state returns what the bot knows about its guilds
+	state() guildState
+	// user returns the bot's user
+	user() *discordgo.User
+	// joinvoice connects to a voice channel, the voice connection can be returned with an error when it timed out
+	joinvoice(guildID, channelID string) (voiceConnection, error)
+}
+
+// discordSession is the session of a shard.
+type discordSession struct {
+	*discordgo.Session
+}
+
+func (s discordSession) state() guildState {
+	return s.State
+}
+
+func (s discordSession) user() *discordgo.User {
+	return s.State.User
+}
+
+func (s discordSession) joinvoice(guildID, channelID string) (voiceConnection, error) {
+	vc, err := s.ChannelVoiceJoin(guildID, channelID, false, true)
+	if vc == nil {
+		return nil, err
+	}
+
+	return discordVoice{vc}, err
+}
+
+// discordVoice is a voice connection of discordgo.
+type discordVoice struct {
+	*discordgo.VoiceConnection
+}
+
+func (v discordVoice) ready() bool {
+	v.RLock()
+	defer v.RUnlock()
+
+	return v.Ready
+}
+
+func (v discordVoice) opus() chan []byte {
+	return v.OpusSend
+}
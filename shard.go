@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// identifyInterval is how long discord wants between the sessions that identify in the same bucket
+const identifyInterval = 5 * time.Second
+
+// open opens the session of every shard, waiting between the buckets of shards that identify together.
+func (b *bot) open() error {
+	for id, s := range b.shards {
+		if id > 0 && id%b.concurrency == 0 {
+			time.Sleep(identifyInterval)
+		}
+
+		err := s.Open()
+		if err != nil {
+			return fmt.Errorf("shard %d: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+// close closes the session of every shard.
+func (b *bot) close() {
+	for id, s := range b.shards {
+		err := s.Close()
+		if err != nil {
+			logs.with("bot", b.id).with("shard", id).err(err).warnf("Cannot close the session")
+		}
+	}
+}
+
+// guildsession returns the session of the shard that a guild belongs to, the guild's voice
+// connections have to go through it. https://discord.com/developers/docs/topics/gateway#sharding
+func (b *bot) guildsession(guildID string) *discordgo.Session {
+	if len(b.shards) == 1 {
+		return b.shards[0]
+	}
+
+	id, err := strconv.ParseUint(guildID, 10, 64)
+	if err != nil {
+		return b.shards[0]
+	}
+
+	return b.shards[(id>>22)%uint64(len(b.shards))]
+}
+
+// setstatus sets the listening status of every shard of every bot, an empty status clears it.
+func setstatus(status string) {
+	for _, b := range bots {
+		for id, s := range b.shards {
+			err := s.UpdateListeningStatus(status)
+			if err != nil {
+				logs.with("bot", b.id).with("shard", id).err(err).warnf("Cannot set the status")
+			}
+		}
+	}
+}
+
+// readyHandler logs when a shard connected to the gateway, and how many guilds it got.
+func readyHandler(s *discordgo.Session, r *discordgo.Ready) {
+	logs.with("bot", r.User.String()).with("shard", s.ShardID).with("guilds", len(r.Guilds)).infof("The shard is ready")
+}
+
+// disconnectHandler logs when a shard lost its connection to the gateway, discordgo reconnects it by itself.
+func disconnectHandler(s *discordgo.Session, d *discordgo.Disconnect) {
+	if isshuttingdown() {
+		return
+	}
+
+	l := logs.with("shard", s.ShardID)
+	if b := botof(s); b != nil {
+		l = logs.with("bot", b.id).with("shard", s.ShardID)
+	}
+
+	l.warnf("The shard disconnected from the gateway")
+}
+
+// shardStatus is the status of a shard that /api/shards returns
+type shardStatus struct {
+	Bot       int     `json:"bot"`
+	ID        int     `json:"id"`
+	Connected bool    `json:"connected"`
+	Guilds    int     `json:"guilds"`
+	Players   int     `json:"players"`
+	Latency   float64 `json:"latency"` // The heartbeat latency in milliseconds, 0 while disconnected
+}
+
+// shardstatus returns the status of every shard of every bot.
+func shardstatus() []shardStatus {
+	var list []shardStatus
+	for _, b := range bots {
+		start := len(list)
+		for id, s := range b.shards {
+			s.RLock()
+			connected := s.DataReady
+			s.RUnlock()
+
+			s.State.RLock()
+			guilds := len(s.State.Guilds)
+			s.State.RUnlock()
+
+			status := shardStatus{
+				Bot:       b.id,
+				ID:        id,
+				Connected: connected,
+				Guilds:    guilds,
+			}
+
+			// The latency is only meaningful once the heartbeat has been acknowledged
+			if connected {
+				status.Latency = float64(s.HeartbeatLatency()) / float64(time.Millisecond)
+			}
+
+			list = append(list, status)
+		}
+
+		b.playersMu.Lock()
+		for id := range b.players {
+			list[start+b.guildsession(id).ShardID].Players++
+		}
+		b.playersMu.Unlock()
+	}
+
+	return list
+}
+
+// apiShards returns the status of every shard, it needs config.API.Token.
+func apiShards(w http.ResponseWriter, r *http.Request) {
+	// The users of the dashboard only control their guilds
+	if requestsession(r) != nil {
+		apiwrite(w, http.StatusForbidden, map[string]string{"error": "the shards need the api's token"})
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		apiwrite(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	apiwrite(w, http.StatusOK, shardstatus())
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// fadeDuration is how long the songs take to fade out when the bot shuts down
+const fadeDuration = time.Second
+
+// shuttingdown is 1 once the bot started shutting down, it's only used atomically.
+// Commands and new ffmpeg processes are refused from then on.
+var shuttingdown int32
+
+// errShuttingDown is returned when something is started while the bot shuts down
+var errShuttingDown = errors.New("the bot is shutting down")
+
+// isshuttingdown returns true once the bot started shutting down.
+func isshuttingdown() bool {
+	return atomic.LoadInt32(&shuttingdown) == 1
+}
+
+// waitforshutdown blocks until the process is interrupted or done is closed, and shuts the bot down then.
+// Interrupting it again exits right away.
+func waitforshutdown(done <-chan struct{}) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, os.Kill, syscall.SIGINT)
+	select {
+	case <-sig:
+	case <-done:
+	}
+
+	logs.infof("Shutting down, press Ctrl+C again to exit right away")
+	go func() {
+		<-sig
+		logs.warnf("Exiting without finishing the shutdown")
+		os.Exit(1)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(getconfig().ShutdownTimeout)*time.Second)
+	defer cancel()
+
+	shutdown(ctx)
+}
+
+// shutdown stops the bot in order: commands and the http servers stop, the players announce it, fade out and
+// leave their voice channels, ffmpeg exits, the state of the guilds is saved and the sessions of the bots are closed.
+// Whatever didn't finish before ctx is done is cut off, so that the bot always exits.
+func shutdown(ctx context.Context) {
+	atomic.StoreInt32(&shuttingdown, 1)
+
+	// Requests that are running get to finish, but new ones are refused
+	for name, srv := range map[string]*http.Server{"api": apiServer, "metrics": metricsServer} {
+		if srv == nil {
+			continue
+		}
+
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			logs.with("server", name).err(err).warnf("Cannot stop the http server in time")
+		}
+	}
+
+	// The websockets are hijacked, so the servers don't close them
+	eventClientsMu.RLock()
+	for _, clients := range eventClients {
+		for c := range clients {
+			c.drop()
+		}
+	}
+	eventClientsMu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, p := range allplayers() {
+		wg.Add(1)
+		go func(p *player) {
+			defer wg.Done()
+			p.stop(ctx)
+		}(p)
+	}
+
+	// The players stop by themselves, or are cut off once ctx is done
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logs.warnf("Not every player stopped in time")
+	}
+
+	// The songs that were being prefetched, or the players that didn't stop in time, can still have ffmpeg running
+	killffmpeg()
+
+	// Every change is saved right away, this only catches the saves that failed. Guilds that never
+	// changed anything don't get empty files.
+	guildMessagesMu.RLock()
+	changed := len(guildMessages) > 0
+	guildMessagesMu.RUnlock()
+	if changed {
+		err := saveguildmessages()
+		if err != nil {
+			logs.err(err).errorf("Cannot save the messages of the guilds")
+		}
+	}
+
+	guildAliasesMu.RLock()
+	changed = len(guildAliases) > 0
+	guildAliasesMu.RUnlock()
+	if changed {
+		err := saveguildaliases()
+		if err != nil {
+			logs.err(err).errorf("Cannot save the aliases of the guilds")
+		}
+	}
+
+	for _, b := range bots {
+		b.close()
+	}
+}
+
+// stop announces the shutdown in the player's text channel, fades the song out and leaves the voice channel.
+// It returns once the song has been closed and ffmpeg exited, or when ctx is done.
+func (p *player) stop(ctx context.Context) {
+	p.mu.Lock()
+	vc, s, textchannel := p.vc, p.session, p.textchannel
+	p.mu.Unlock()
+
+	if vc == nil {
+		return
+	}
+
+	if len(textchannel) > 0 && s != nil {
+		_, err := s.ChannelMessageSend(textchannel, message(p.guildID, findcommand("leave"), "shutdown"))
+		if err != nil {
+			p.log().err(err).warnf("Cannot announce the shutdown")
+		}
+	}
+
+	p.fadeout(ctx)
+
+	// run() closes the song once vc is nil, and returns right after since the player is stopping
+	p.quit()
+
+	select {
+	case <-p.stopped:
+	case <-ctx.Done():
+	}
+}
+
+// fadeout lowers the volume of the current song to nothing over fadeDuration.
+func (p *player) fadeout(ctx context.Context) {
+	p.mu.Lock()
+	playing, volume := p.playingAudio && !p.pause, p.volume
+	p.mu.Unlock()
+
+	if !playing {
+		return
+	}
+
+	steps := int(fadeDuration / discordFrameDuration)
+	for i := steps - 1; i >= 0; i-- {
+		// The volume is changed directly, so that the clients don't see the volume changing
+		p.mu.Lock()
+		p.volume = volume * float64(i) / float64(steps)
+		p.mu.Unlock()
+
+		select {
+		case <-time.After(discordFrameDuration):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
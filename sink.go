@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"gopkg.in/hraban/opus.v2"
+)
+
+// audioSink is where the console writes the opus frames that the player sends, instead of a voice channel.
+type audioSink interface {
+	// WriteFrame writes a single opus frame.
+	WriteFrame(frame []byte) error
+	// Close finishes the file, the writer isn't closed.
+	Close() error
+}
+
+// newsink returns a sink of format, one of ogg or wav, that writes to w.
+func newsink(format string, w io.Writer, audio AudioConfig) (audioSink, error) {
+	switch format {
+	case "ogg":
+		return newOggWriter(w, audio.Channels)
+	case "wav":
+		return newWAVWriter(w, audio.Channels)
+	}
+
+	return nil, fmt.Errorf("the output format must be ogg or wav, not %q", format)
+}
+
+// Ogg/Opus is documented in https://datatracker.ietf.org/doc/html/rfc7845, and the Ogg pages in
+// https://datatracker.ietf.org/doc/html/rfc3533#section-6
+const (
+	oggPageBOS = 0x02
+	oggPageEOS = 0x04
+
+	// oggPreSkip is how many samples the decoder drops at the start, it's the lookahead of libopus
+	oggPreSkip = 312
+)
+
+// oggCRC is the lookup table of the checksum of the Ogg pages, it's a crc32 that isn't reflected.
+var oggCRC = func() (table [256]uint32) {
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+
+		table[i] = r
+	}
+
+	return table
+}()
+
+// oggchecksum returns the checksum of an Ogg page.
+func oggchecksum(page []byte) uint32 {
+	var crc uint32
+	for _, b := range page {
+		crc = crc<<8 ^ oggCRC[byte(crc>>24)^b]
+	}
+
+	return crc
+}
+
+// oggWriter writes opus frames into an Ogg container, one frame per page.
+type oggWriter struct {
+	w      io.Writer
+	serial uint32
+	page   uint32
+	// granule is how many samples at 48kHz have been written
+	granule uint64
+}
+
+// newOggWriter writes the opus headers to w, and returns a writer for the frames.
+func newOggWriter(w io.Writer, channels int) (*oggWriter, error) {
+	o := &oggWriter{w: w, serial: uint32(time.Now().UnixNano())}
+
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1 // version
+	head[9] = byte(channels)
+	binary.LittleEndian.PutUint16(head[10:], oggPreSkip)
+	binary.LittleEndian.PutUint32(head[12:], audioFrameRate)
+	// The output gain and the channel mapping are 0
+
+	err := o.writepage(head, oggPageBOS)
+	if err != nil {
+		return nil, err
+	}
+
+	vendor := "musicbot"
+	tags := make([]byte, 8+4+len(vendor)+4)
+	copy(tags, "OpusTags")
+	binary.LittleEndian.PutUint32(tags[8:], uint32(len(vendor)))
+	copy(tags[12:], vendor)
+	// There are no comments
+
+	err = o.writepage(tags, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// WriteFrame writes a frame on its own page.
+func (o *oggWriter) WriteFrame(frame []byte) error {
+	d := opusFrameDuration(frame)
+	if d == 0 {
+		return errors.New("ogg: invalid opus frame")
+	}
+
+	o.granule += uint64(d * audioFrameRate / time.Second)
+	return o.writepage(frame, 0)
+}
+
+// Close writes an empty page that ends the stream.
+func (o *oggWriter) Close() error {
+	return o.writepage(nil, oggPageEOS)
+}
+
+// writepage writes packet as a page of its own.
+func (o *oggWriter) writepage(packet []byte, flags byte) error {
+	// The sizes of the segments are 255 until the last one, which is shorter. A nil packet gives a page without segments.
+	segments := 0
+	if packet != nil {
+		segments = len(packet)/255 + 1
+	}
+
+	if segments > 255 {
+		return errors.New("ogg: the packet is too big for a page")
+	}
+
+	page := make([]byte, 27+segments+len(packet))
+	copy(page, "OggS")
+	page[5] = flags
+	binary.LittleEndian.PutUint64(page[6:], o.granule)
+	binary.LittleEndian.PutUint32(page[14:], o.serial)
+	binary.LittleEndian.PutUint32(page[18:], o.page)
+	page[26] = byte(segments)
+	for i := 0; i < segments; i++ {
+		page[27+i] = 255
+	}
+	if segments > 0 {
+		page[27+segments-1] = byte(len(packet) % 255)
+	}
+	copy(page[27+segments:], packet)
+
+	// The checksum is computed with the checksum field set to 0
+	binary.LittleEndian.PutUint32(page[22:], oggchecksum(page))
+
+	o.page++
+	_, err := o.w.Write(page)
+	return err
+}
+
+// wavHeaderSize is the size of the RIFF header of a WAV file with 16 bit pcm
+const wavHeaderSize = 44
+
+// wavWriter decodes opus frames and writes them as 16 bit pcm in a WAV file.
+type wavWriter struct {
+	w        io.Writer
+	dec      *opus.Decoder
+	channels int
+	pcm      []int16
+	// size is how many bytes of pcm have been written
+	size int64
+}
+
+// newWAVWriter writes the header of a WAV file to w, and returns a writer for the frames. The sizes in the header are unknown
+// until the writer is closed, so they are the biggest possible and only written when w can seek.
+func newWAVWriter(w io.Writer, channels int) (*wavWriter, error) {
+	dec, err := opus.NewDecoder(audioFrameRate, channels)
+	if err != nil {
+		return nil, err
+	}
+
+	wv := &wavWriter{w: w, dec: dec, channels: channels, pcm: make([]int16, maxFrameSize*channels)}
+
+	_, err = w.Write(wv.header(math.MaxUint32 - wavHeaderSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return wv, nil
+}
+
+// header returns the RIFF header for size bytes of pcm.
+func (wv *wavWriter) header(size uint32) []byte {
+	h := make([]byte, wavHeaderSize)
+	copy(h, "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], size+wavHeaderSize-8)
+	copy(h[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], 1) // pcm
+	binary.LittleEndian.PutUint16(h[22:], uint16(wv.channels))
+	binary.LittleEndian.PutUint32(h[24:], audioFrameRate)
+	binary.LittleEndian.PutUint32(h[28:], uint32(audioFrameRate*wv.channels*2))
+	binary.LittleEndian.PutUint16(h[32:], uint16(wv.channels*2))
+	binary.LittleEndian.PutUint16(h[34:], 16)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], size)
+	return h
+}
+
+// WriteFrame decodes a frame and writes its samples.
+func (wv *wavWriter) WriteFrame(frame []byte) error {
+	n, err := wv.dec.Decode(frame, wv.pcm)
+	if err != nil {
+		return err
+	}
+
+	err = binary.Write(wv.w, binary.LittleEndian, wv.pcm[:n*wv.channels])
+	if err != nil {
+		return err
+	}
+
+	wv.size += int64(n * wv.channels * 2)
+	return nil
+}
+
+// Close writes the sizes to the header, if w can seek.
+func (wv *wavWriter) Close() error {
+	ws, ok := wv.w.(io.WriteSeeker)
+	if !ok {
+		return nil
+	}
+
+	// Pipes are files too, but they cannot seek
+	_, err := ws.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil
+	}
+
+	size := wv.size
+	if size > math.MaxUint32-wavHeaderSize {
+		size = math.MaxUint32 - wavHeaderSize
+	}
+
+	_, err = ws.Write(wv.header(uint32(size)))
+	return err
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// oggPage is a page that readoggpages read
+type oggPage struct {
+	flags   byte
+	granule uint64
+	packets [][]byte
+}
+
+// readoggpages reads the pages of an Ogg stream, and checks their checksums and sequence numbers.
+func readoggpages(t *testing.T, data []byte) []oggPage {
+	t.Helper()
+
+	var pages []oggPage
+	for len(data) > 0 {
+		if len(data) < 27 || string(data[:4]) != "OggS" {
+			t.Fatalf("page %d doesn't start with OggS", len(pages))
+		}
+
+		segments := int(data[26])
+		size := 27 + segments
+		var packets [][]byte
+		var packet []byte
+		for _, lacing := range data[27 : 27+segments] {
+			packet = append(packet, data[size:size+int(lacing)]...)
+			size += int(lacing)
+			if lacing < 255 {
+				packets = append(packets, packet)
+				packet = nil
+			}
+		}
+
+		page := append([]byte{}, data[:size]...)
+		crc := binary.LittleEndian.Uint32(page[22:])
+		binary.LittleEndian.PutUint32(page[22:], 0)
+		if oggchecksum(page) != crc {
+			t.Errorf("page %d has an invalid checksum", len(pages))
+		}
+
+		if seq := binary.LittleEndian.Uint32(page[18:]); seq != uint32(len(pages)) {
+			t.Errorf("page %d has the sequence number %d", len(pages), seq)
+		}
+
+		pages = append(pages, oggPage{flags: page[5], granule: binary.LittleEndian.Uint64(page[6:]), packets: packets})
+		data = data[size:]
+	}
+
+	return pages
+}
+
+func TestOggChecksum(t *testing.T) {
+	// The check value of the crc32 that isn't reflected, without the final xor
+	if crc := oggchecksum([]byte("123456789")); crc != 0x89a1897f {
+		t.Errorf("checksum is %#x, want 0x89a1897f", crc)
+	}
+}
+
+func TestOggWriter(t *testing.T) {
+	var buf bytes.Buffer
+	o, err := newOggWriter(&buf, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frames := [][]byte{
+		{0xfc, 0x01},                    // 20ms
+		{0xfd, 0x02, 0x03},              // two frames of 20ms
+		bytes.Repeat([]byte{0xfc}, 300), // a packet that needs two segments
+	}
+
+	for _, frame := range frames {
+		err = o.WriteFrame(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = o.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pages := readoggpages(t, buf.Bytes())
+	if len(pages) != len(frames)+3 {
+		t.Fatalf("wrote %d pages, want %d", len(pages), len(frames)+3)
+	}
+
+	if pages[0].flags != oggPageBOS || !bytes.HasPrefix(pages[0].packets[0], []byte("OpusHead")) || pages[0].packets[0][9] != 2 {
+		t.Errorf("the first page isn't the OpusHead of two channels")
+	}
+
+	if !bytes.HasPrefix(pages[1].packets[0], []byte("OpusTags")) {
+		t.Errorf("the second page isn't the OpusTags")
+	}
+
+	granules := []uint64{960, 2880, 3840}
+	for i, frame := range frames {
+		page := pages[i+2]
+		if len(page.packets) != 1 || !bytes.Equal(page.packets[0], frame) {
+			t.Errorf("page %d doesn't hold frame %d", i+2, i)
+		}
+
+		if page.granule != granules[i] {
+			t.Errorf("page %d has the granule %d, want %d", i+2, page.granule, granules[i])
+		}
+	}
+
+	last := pages[len(pages)-1]
+	if last.flags != oggPageEOS || len(last.packets) != 0 || last.granule != 3840 {
+		t.Errorf("the last page doesn't end the stream")
+	}
+}
+
+func TestWAVWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.wav")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	wv, err := newWAVWriter(f, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		err = wv.WriteFrame([]byte{0xfc, 0xff, 0xfe})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = wv.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Three frames of 20ms, in 16 bit stereo
+	size := 3 * 960 * 2 * 2
+	if len(data) != wavHeaderSize+size {
+		t.Fatalf("the file has %d bytes, want %d", len(data), wavHeaderSize+size)
+	}
+
+	if string(data[:4]) != "RIFF" || string(data[8:16]) != "WAVEfmt " || string(data[36:40]) != "data" {
+		t.Errorf("the file doesn't start with a WAV header")
+	}
+
+	if got := binary.LittleEndian.Uint32(data[40:]); got != uint32(size) {
+		t.Errorf("the header has the size %d, want %d", got, size)
+	}
+}
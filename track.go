@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	ytdl "github.com/kkdai/youtube/v2"
+)
+
+// discordFrameDuration is how long every frame sent to discord has to be, discordgo sends a frame every 20ms.
+const discordFrameDuration = 20 * time.Millisecond
+
+// track is a song that has been opened and is ready to be sent to the voice connection.
+// Youtube videos are either streamed through ffmpeg, or their opus frames are sent as they are.
+// DCA files are read directly.
+type track struct {
+	p   *player
+	vid *videoInfo
+	// start is where the song starts playing from, it's set when a song gets resumed.
+	start time.Duration
+
+	// pcm is the youtube stream converted by ffmpeg.
+	pcm *pcmstream
+
+	// webm holds the opus frames of the youtube stream dl, when they are passed through.
+	dl   io.ReadCloser
+	webm *webmReader
+
+	// file is the DCA file that dca reads from.
+	file *os.File
+	dca  *dcaReader
+}
+
+// opentrack resolves the stream of vid and starts converting it, or opens its DCA file.
+// Songs that have been recorded before are opened from their DCA file.
+func (p *player) opentrack(vid *videoInfo) (*track, error) {
+	file := vid.File
+	if file == "" && vid.Base != nil {
+		cached := filepath.Join(getconfig().DcaPath, vid.Base.ID+dcaExtension)
+		if _, err := os.Stat(cached); err == nil {
+			file = cached
+		}
+	}
+
+	t := &track{p: p, vid: vid}
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+
+		t.file = f
+		t.dca, err = newDCAReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		return t, nil
+	}
+
+	format := pickformat(vid.Base.Formats.Type("audio"))
+	if format == nil {
+		return nil, fmt.Errorf("%s has no audio formats", vid.Base.ID)
+	}
+
+	t.log().debugf("Picked the format %s", format.MimeType)
+	dl, err := getstream(vid.Base, format)
+	if err != nil {
+		return nil, err
+	}
+
+	// The next song is opened while the current one plays
+	p.mu.Lock()
+	volume, audio := p.volume, p.audio
+	p.mu.Unlock()
+
+	// When the volume isn't changed, there is no need to decode and encode the frames again
+	if getconfig().OpusPassthrough && volume == 1 && isopusformat(format) {
+		err = t.openpassthrough(dl)
+		if err == nil {
+			return t, nil
+		}
+
+		t.log().err(err).infof("Cannot pass the opus frames through, transcoding them instead")
+
+		// Part of the stream has been read already, so it has to be opened again for ffmpeg
+		dl.Close()
+		dl, err = getstream(vid.Base, format)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t.pcm, err = startffmpeg(dl, audio)
+	if err != nil {
+		dl.Close()
+		return nil, err
+	}
+
+	// Give ffmpeg a head start
+	t.pcm.Prebuffer()
+
+	return t, nil
+}
+
+// fileScheme starts the urls of the local files that the console plays
+const fileScheme = "file://"
+
+// islocal returns true if vid is a local file of the console, it's not on youtube.
+func islocal(vid *ytdl.Video) bool {
+	return len(vid.Formats) > 0 && strings.HasPrefix(vid.Formats[0].URL, fileScheme)
+}
+
+// getstream opens the stream of a format, and measures how long youtube takes to open it.
+// The local files of the console are opened directly.
+func getstream(vid *ytdl.Video, format *ytdl.Format) (io.ReadCloser, error) {
+	if strings.HasPrefix(format.URL, fileScheme) {
+		return os.Open(strings.TrimPrefix(format.URL, fileScheme))
+	}
+
+	start := time.Now()
+	dl, _, err := ytcl.GetStream(vid, format)
+	metricStreamResolve.since(start)
+	if err != nil {
+		metricStreamFailures.inc()
+		return nil, fmt.Errorf("ytcl.GetStream: %w", err)
+	}
+
+	return dl, nil
+}
+
+// openpassthrough demuxes the opus frames of dl. Discord needs frames of discordFrameDuration,
+// so the first frame is checked before the stream is passed through.
+func (t *track) openpassthrough(dl io.ReadCloser) error {
+	webm, err := newWebMReader(dl)
+	if err != nil {
+		return err
+	}
+
+	frame, err := webm.ReadFrame()
+	if err != nil {
+		return err
+	}
+
+	if d := opusFrameDuration(frame); d != discordFrameDuration {
+		return fmt.Errorf("frames are %s long", d)
+	}
+
+	webm.unreadFrame(frame)
+
+	t.dl = dl
+	t.webm = webm
+	return nil
+}
+
+// pickformat picks the smallest opus format, since opus frames can be sent to discord as they are.
+// If there is no opus format, the smallest format is picked.
+func pickformat(formats ytdl.FormatList) *ytdl.Format {
+	var format *ytdl.Format
+	for k := range formats {
+		v := &formats[k]
+		if format == nil {
+			format = v
+			continue
+		}
+
+		if getconfig().OpusPassthrough && isopusformat(v) != isopusformat(format) {
+			if isopusformat(v) {
+				format = v
+			}
+			continue
+		}
+
+		if v.ContentLength < format.ContentLength {
+			format = v
+		}
+	}
+
+	return format
+}
+
+// isopusformat returns true if format is opus inside of a webm container.
+func isopusformat(format *ytdl.Format) bool {
+	return strings.HasPrefix(format.MimeType, "audio/webm") && strings.Contains(format.MimeType, "opus")
+}
+
+// source returns where the frames of the track come from, one of dca, passthrough or ffmpeg.
+func (t *track) source() string {
+	if t.dca != nil {
+		return "dca"
+	} else if t.webm != nil {
+		return "passthrough"
+	}
+
+	return "ffmpeg"
+}
+
+// play sends the track to the voice connection, and records it when config.DcaRecord is set.
+// It returns true if the song has been played until the end.
+func (t *track) play() bool {
+	p := t.p
+	if t.dca != nil {
+		frameduration := p.audio.frameDuration()
+		if meta := t.dca.Metadata; meta != nil && meta.Opus.FrameSize > 0 && meta.Opus.SampleRate > 0 {
+			frameduration = time.Duration(meta.Opus.FrameSize) * time.Second / time.Duration(meta.Opus.SampleRate)
+		}
+
+		return p.sendopus(t.dca, frameduration, nil, t.start)
+	}
+
+	var rec *dcaWriter
+	var recfile *os.File
+	var err error
+	c := getconfig()
+	// A song that got resumed would only be partly recorded
+	if c.DcaRecord && t.start == 0 {
+		recfile, err = os.Create(filepath.Join(c.DcaPath, p.guildID+"-"+dcaFilename))
+		if err == nil {
+			defer recfile.Close()
+
+			audio := p.audio
+			// The frames of opus streams are recorded as they are, they are 20ms whatever the encoder's frame size is
+			if t.webm != nil {
+				audio.FrameSize = int(discordFrameDuration * audioFrameRate / time.Second)
+			}
+
+			rec, err = newDCAWriter(recfile, newDCAMetadata(t.vid, audio))
+			if err != nil {
+				t.log().err(err).warnf("Cannot record the song")
+			}
+		} else {
+			t.log().err(err).warnf("Cannot record the song")
+		}
+	}
+
+	var complete bool
+	if t.webm != nil {
+		complete = p.sendopus(t.webm, discordFrameDuration, rec, t.start)
+	} else {
+		complete = p.send(t.pcm, rec, t.start)
+	}
+
+	if complete && rec != nil && rec.err == nil {
+		recfile.Close()
+		os.Rename(recfile.Name(), filepath.Join(c.DcaPath, t.vid.Base.ID+dcaExtension))
+	}
+
+	return complete
+}
+
+// Close stops ffmpeg and closes the stream, or closes the file of the track.
+func (t *track) Close() {
+	if t.pcm != nil {
+		t.pcm.Close()
+	}
+
+	if t.dl != nil {
+		t.dl.Close()
+	}
+
+	if t.file != nil {
+		t.file.Close()
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// join connects the player to a voice channel of its guild, and matches the encoder's bitrate to the channel's.
+func (p *player) join(s session, channelID string) error {
+	vc, err := s.joinvoice(p.guildID, channelID)
+
+	p.mu.Lock()
+	p.session = s
+	p.vc = vc
+	if err != nil {
+		p.mu.Unlock()
+		return err
+	}
+
+	p.idlesince = time.Time{}
+	p.mu.Unlock()
+
+	p.moved(s, channelID)
+
+	return nil
+}
+
+// connected returns true if the player is in a voice channel.
+func (p *player) connected() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.vc != nil
+}
+
+// move moves the player to another voice channel of its guild, the song keeps playing.
+func (p *player) move(s session, channelID string) error {
+	p.mu.Lock()
+	vc := p.vc
+	p.mu.Unlock()
+
+	if vc == nil {
+		return p.join(s, channelID)
+	}
+
+	err := vc.ChangeChannel(channelID, false, true)
+	if err != nil {
+		return err
+	}
+
+	p.moved(s, channelID)
+	return nil
+}
+
+// moved updates the player after it has been moved to channelID, either by move or by a moderator.
+func (p *player) moved(s session, channelID string) {
+	p.mu.Lock()
+	p.channelID = channelID
+	// The users of the old channel don't matter anymore
+	p.stopalonetimer()
+	p.mu.Unlock()
+
+	ch, err := s.state().Channel(channelID)
+	if err == nil {
+		p.matchbitrate(ch)
+	}
+
+	p.checkalone(s)
+
+	p.emit(eventVoiceJoined, map[string]string{"channel": channelID})
+}
+
+// leave disconnects the player from its voice channel, the queue is kept.
+func (p *player) leave() {
+	p.mu.Lock()
+	vc := p.vc
+	if vc == nil {
+		p.mu.Unlock()
+		return
+	}
+
+	p.stopalonetimer()
+
+	// The song stops once vc is nil, give it some time before disconnecting
+	p.vc = nil
+	p.channelID = ""
+	p.mu.Unlock()
+
+	p.discardprefetch()
+	time.Sleep(time.Millisecond * 50)
+	vc.Disconnect()
+
+	p.emit(eventVoiceLeft, nil)
+}
+
+// voiceTimeout is how long a frame can wait for the voice connection before it's considered dead.
+const voiceTimeout = 2 * time.Second
+
+// sendframe sends an opus frame to vc. If the voice connection isn't ready or doesn't take the frame
+// within voiceTimeout, the song is interrupted at its current position and false is returned.
+func (p *player) sendframe(vc voiceConnection, frame []byte) bool {
+	if !vc.ready() {
+		p.interrupt()
+		return false
+	}
+
+	if p.sendtimer == nil {
+		p.sendtimer = time.NewTimer(voiceTimeout)
+	} else {
+		p.sendtimer.Reset(voiceTimeout)
+	}
+
+	// The voice connection sent every frame that it had before this one arrived
+	if p.streaming && len(vc.opus()) == 0 {
+		metricFrameUnderruns.inc()
+	}
+
+	start := time.Now()
+	select {
+	case vc.opus() <- frame:
+		if !p.sendtimer.Stop() {
+			<-p.sendtimer.C
+		}
+
+		metricFrameSend.since(start)
+		metricFrames.inc()
+		p.streaming = true
+		return true
+	case <-p.sendtimer.C:
+		p.interrupt()
+		return false
+	}
+}
+
+// interrupt marks the current song as cut off by the voice connection, so that it's resumed once the player reconnected.
+func (p *player) interrupt() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.log().with("position", p.position).warnf("Lost the voice connection")
+	p.resume = p.position
+	p.interrupted = true
+}
+
+// recover reconnects the player to its voice channel, waiting twice as long after every failed attempt.
+// If it doesn't reconnect after config.ReconnectAttempts, the player leaves the voice channel.
+func (p *player) recover() {
+	// The voice connection might be recovered from run() and from the handlers at the same time
+	if !atomic.CompareAndSwapInt32(&p.recovering, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&p.recovering, 0)
+
+	attempts := getconfig().ReconnectAttempts
+	wait := time.Second
+	for attempt := 1; attempt <= attempts; attempt++ {
+		time.Sleep(wait)
+		wait *= 2
+
+		// The player left the voice channel in the meantime
+		p.mu.Lock()
+		vc, s, channelID := p.vc, p.session, p.channelID
+		if vc == nil {
+			p.resume = 0
+			p.mu.Unlock()
+			return
+		}
+		p.mu.Unlock()
+
+		// discordgo reconnects by itself when the voice websocket closes
+		if vc.ready() {
+			p.log().infof("Recovered the voice connection")
+			return
+		}
+
+		err := p.join(s, channelID)
+		if err == nil {
+			p.log().infof("Reconnected to the voice channel")
+			return
+		}
+
+		p.log().err(err).warnf("Cannot reconnect to the voice channel, attempt %d of %d", attempt, attempts)
+	}
+
+	p.log().errorf("Cannot recover the voice connection, leaving")
+	p.mu.Lock()
+	p.resume = 0
+	p.mu.Unlock()
+	p.leave()
+}
+
+// checkidle leaves the voice channel once the queue has been over for config.IdleTimeout.
+func (p *player) checkidle() {
+	c := getconfig()
+	if c.IdleTimeout <= 0 || c.alwaysOn(p.guildID) {
+		return
+	}
+
+	p.mu.Lock()
+	if p.idlesince.IsZero() {
+		p.idlesince = time.Now()
+		p.mu.Unlock()
+		return
+	}
+
+	idle := time.Since(p.idlesince) >= time.Duration(c.IdleTimeout)*time.Second
+	if idle {
+		p.idlesince = time.Time{}
+	}
+	p.mu.Unlock()
+
+	if idle {
+		p.log().infof("Leaving, the queue has been over for %d seconds", c.IdleTimeout)
+		p.leave()
+	}
+}
+
+// checkalone pauses the song when the bot is alone in its voice channel, and leaves after config.AloneTimeout.
+// When somebody joins again before that, the song is resumed.
+func (p *player) checkalone(s session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.vc == nil {
+		return
+	}
+
+	alone := listeners(s, p.guildID, p.channelID) == 0
+	if alone && !p.alone {
+		p.alone = true
+		if p.setpauselocked(true) {
+			p.autopaused = true
+		}
+
+		c := getconfig()
+		if c.AloneTimeout > 0 && !c.alwaysOn(p.guildID) {
+			p.alonetimer = time.AfterFunc(time.Duration(c.AloneTimeout)*time.Second, func() {
+				p.log().infof("Leaving, nobody has been listening for %d seconds", c.AloneTimeout)
+				p.leave()
+			})
+		}
+	} else if !alone && p.alone {
+		p.stopalonetimer()
+	}
+}
+
+// stopalonetimer stops the timer of checkalone, and resumes the song if it was paused by it. p.mu must be held.
+func (p *player) stopalonetimer() {
+	p.alone = false
+	if p.alonetimer != nil {
+		p.alonetimer.Stop()
+		p.alonetimer = nil
+	}
+
+	if p.autopaused {
+		p.setpauselocked(false)
+		p.autopaused = false
+	}
+}
+
+// uservoicechannel returns the voice channel that a user is in, or an empty string if the user isn't in one.
+func uservoicechannel(s session, guildID, userID string) string {
+	guild, err := s.state().Guild(guildID)
+	if err != nil {
+		return ""
+	}
+
+	for _, vs := range guild.VoiceStates {
+		if vs.UserID == userID {
+			return vs.ChannelID
+		}
+	}
+
+	return ""
+}
+
+// listeners returns how many users, that aren't bots, are inside of a voice channel.
+func listeners(s session, guildID, channelID string) int {
+	guild, err := s.state().Guild(guildID)
+	if err != nil {
+		return 0
+	}
+
+	count := 0
+	for _, vs := range guild.VoiceStates {
+		if vs.ChannelID != channelID || vs.UserID == s.user().ID {
+			continue
+		}
+
+		member := vs.Member
+		if member == nil {
+			member, _ = s.state().Member(guildID, vs.UserID)
+		}
+
+		if member != nil && member.User != nil && member.User.Bot {
+			continue
+		}
+
+		count++
+	}
+
+	return count
+}
+
+// voiceStateUpdateHandler checks if the bot is alone, whenever somebody joins or leaves the bot's voice channel.
+// If the bot has been disconnected without leaving by itself, the player reconnects,
+// and if it has been moved to another channel, the player follows it.
+func voiceStateUpdateHandler(s *discordgo.Session, v *discordgo.VoiceStateUpdate) {
+	b := botof(s)
+	if b == nil {
+		return
+	}
+
+	p := b.findplayer(v.GuildID)
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	vc, channelID, playing := p.vc, p.channelID, p.playingAudio
+	p.mu.Unlock()
+	if vc == nil {
+		return
+	}
+
+	if v.UserID == s.State.User.ID {
+		if v.ChannelID == "" {
+			// discordgo keeps the dead voice connection, closing it makes the song stop and recover
+			vc.Close()
+			if !playing {
+				go p.recover()
+			}
+		} else if v.ChannelID != channelID {
+			p.log().infof("Moved from %s to %s", channelID, v.ChannelID)
+			p.moved(discordSession{s}, v.ChannelID)
+		}
+
+		return
+	}
+
+	if v.ChannelID == channelID || (v.BeforeUpdate != nil && v.BeforeUpdate.ChannelID == channelID) {
+		p.checkalone(discordSession{s})
+	}
+}
+
+// resumedHandler recovers the voice connections that died while the gateway was reconnecting.
+// The players that are playing a song notice it by themselves.
+func resumedHandler(s *discordgo.Session, r *discordgo.Resumed) {
+	b := botof(s)
+	if b == nil {
+		return
+	}
+
+	b.playersMu.Lock()
+	defer b.playersMu.Unlock()
+
+	for guildID, p := range b.players {
+		// The other shards have their own guilds
+		if b.guildsession(guildID) != s {
+			continue
+		}
+
+		p.mu.Lock()
+		vc, playing := p.vc, p.playingAudio
+		p.mu.Unlock()
+
+		if vc != nil && !playing && !vc.ready() {
+			go p.recover()
+		}
+	}
+}
+
+// matchbitrate sets the encoder's bitrate to the bitrate of the voice channel, capped by audio.MaxBitrate.
+// Boosted servers have channels with higher bitrates, so songs sound better there. The encoder is only
+// used by run(), so the bitrate is stored in p.bitrate and applybitrate changes it between the frames.
+func (p *player) matchbitrate(ch *discordgo.Channel) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.audio.MaxBitrate <= 0 || ch.Bitrate <= 0 {
+		return
+	}
+
+	bitrate := ch.Bitrate / 1000
+	if bitrate > p.audio.MaxBitrate {
+		bitrate = p.audio.MaxBitrate
+	}
+
+	p.bitrate = bitrate
+	if bitrate == p.audio.Bitrate {
+		p.bitrate = 0
+	}
+}
+
+// applybitrate sets the encoder's bitrate to the one that matchbitrate picked, it's only called by run().
+func (p *player) applybitrate() {
+	p.mu.Lock()
+	bitrate := p.bitrate
+	p.bitrate = 0
+	p.mu.Unlock()
+
+	if bitrate == 0 {
+		return
+	}
+
+	err := p.encoder.SetBitrate(bitrate * 1000)
+	if err != nil {
+		p.log().err(err).warnf("Cannot set the bitrate to %d kbps", bitrate)
+		return
+	}
+
+	p.mu.Lock()
+	p.audio.Bitrate = bitrate
+	p.mu.Unlock()
+}
+
+// channelUpdateHandler matches the bitrate of the players that are inside of a voice channel which has been updated.
+func channelUpdateHandler(s *discordgo.Session, c *discordgo.ChannelUpdate) {
+	if c.Type != discordgo.ChannelTypeGuildVoice && c.Type != discordgo.ChannelTypeGuildStageVoice {
+		return
+	}
+
+	b := botof(s)
+	if b == nil {
+		return
+	}
+
+	p := b.findplayer(c.GuildID)
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	inside := p.vc != nil && p.channelID == c.ID
+	p.mu.Unlock()
+
+	if inside {
+		p.matchbitrate(c.Channel)
+	}
+}
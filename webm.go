@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+// WebM is a subset of Matroska, which is built on EBML. Every element starts with an id and
+// a size, both stored as variable length integers. Youtube's audio only WebM files have a single
+// opus track, and the frames are stored in the blocks of each cluster.
+// https://www.matroska.org/technical/elements.html
+const (
+	ebmlHeaderID  = 0x1A45DFA3
+	ebmlDocTypeID = 0x4282
+
+	webmSegmentID     = 0x18538067
+	webmTracksID      = 0x1654AE6B
+	webmTrackEntryID  = 0xAE
+	webmTrackNumberID = 0xD7
+	webmCodecID       = 0x86
+	webmClusterID     = 0x1F43B675
+	webmBlockGroupID  = 0xA0
+	webmBlockID       = 0xA1
+	webmSimpleBlockID = 0xA3
+
+	// webmUnknownSize is used by master elements that are being streamed, their size isn't known.
+	webmUnknownSize = -1
+
+	// webmOpusCodec is the CodecID of opus tracks
+	webmOpusCodec = "A_OPUS"
+
+	// webmMaxDataSize is the biggest element that is read into memory, which is 512 KB.
+	webmMaxDataSize = 1024 * 512
+)
+
+var (
+	errWebMInvalid = errors.New("webm: invalid file")
+	errWebMNoOpus  = errors.New("webm: there is no opus track")
+)
+
+// webmReader reads the opus frames of the first opus track in a WebM file.
+type webmReader struct {
+	r *bufio.Reader
+
+	// track is the number of the opus track, it's 0 until the track entry is read.
+	track uint64
+	// entry holds the number and codec of the track entry that is being read
+	entry struct {
+		number uint64
+		codec  string
+	}
+
+	// frames holds the frames of a laced block that haven't been read yet.
+	frames [][]byte
+}
+
+// newWebMReader reads the EBML header from r, and makes sure that r is a WebM or Matroska file.
+func newWebMReader(r io.Reader) (*webmReader, error) {
+	w := &webmReader{r: bufio.NewReader(r)}
+
+	id, size, err := w.readElement()
+	if err != nil {
+		return nil, err
+	}
+
+	if id != ebmlHeaderID || size < 0 {
+		return nil, errWebMInvalid
+	}
+
+	header := make([]byte, size)
+	_, err = io.ReadFull(w.r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	// The children of the header are small, so they are parsed from memory
+	hr := &webmReader{r: bufio.NewReader(bytes.NewReader(header))}
+	for {
+		id, size, err := hr.readElement()
+		if err == io.EOF {
+			return nil, errWebMInvalid
+		} else if err != nil {
+			return nil, err
+		}
+
+		data, err := hr.readData(size)
+		if err != nil {
+			return nil, err
+		}
+
+		if id == ebmlDocTypeID {
+			doctype := string(trimNull(data))
+			if doctype != "webm" && doctype != "matroska" {
+				return nil, errWebMInvalid
+			}
+
+			return w, nil
+		}
+	}
+}
+
+// ReadFrame returns the next opus frame. It returns io.EOF when the stream ends after a whole element,
+// and io.ErrUnexpectedEOF when it's cut off in the middle of one.
+func (w *webmReader) ReadFrame() ([]byte, error) {
+	for len(w.frames) == 0 {
+		id, size, err := w.readElement()
+		if err != nil {
+			return nil, err
+		}
+
+		switch id {
+		// Master elements that hold the elements we need are entered, instead of being skipped
+		case webmSegmentID, webmTracksID, webmClusterID, webmBlockGroupID:
+		case webmTrackEntryID:
+			w.entry.number = 0
+			w.entry.codec = ""
+		case webmTrackNumberID, webmCodecID:
+			data, err := w.readData(size)
+			if err != nil {
+				return nil, err
+			}
+
+			if id == webmTrackNumberID {
+				w.entry.number = readUint(data)
+			} else {
+				w.entry.codec = string(trimNull(data))
+			}
+
+			if w.track == 0 && w.entry.number > 0 && w.entry.codec == webmOpusCodec {
+				w.track = w.entry.number
+			}
+		case webmSimpleBlockID, webmBlockID:
+			data, err := w.readData(size)
+			if err != nil {
+				return nil, err
+			}
+
+			if w.track == 0 {
+				return nil, errWebMNoOpus
+			}
+
+			err = w.readBlock(data)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			if size == webmUnknownSize {
+				return nil, errWebMInvalid
+			}
+
+			_, err = w.r.Discard(int(size))
+			if err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	frame := w.frames[0]
+	w.frames = w.frames[1:]
+
+	return frame, nil
+}
+
+// unreadFrame puts frame back, so that it's returned by the next ReadFrame.
+func (w *webmReader) unreadFrame(frame []byte) {
+	w.frames = append([][]byte{frame}, w.frames...)
+}
+
+// readBlock reads the frames of a block, if it belongs to the opus track.
+func (w *webmReader) readBlock(data []byte) error {
+	track, n := readVint(data, false)
+	// The track number is followed by the timecode, which is 2 bytes, and the flags
+	if n == 0 || len(data) < n+3 {
+		return errWebMInvalid
+	}
+
+	if track != w.track {
+		return nil
+	}
+
+	flags := data[n+2]
+	data = data[n+3:]
+
+	switch (flags >> 1) & 3 {
+	case 0: // no lacing
+		w.frames = append(w.frames, data)
+		return nil
+	case 1: // xiph lacing
+		return w.readXiphLacing(data)
+	case 2: // fixed-size lacing
+		if len(data) < 1 {
+			return errWebMInvalid
+		}
+
+		count := int(data[0]) + 1
+		data = data[1:]
+		if len(data)%count != 0 {
+			return errWebMInvalid
+		}
+
+		size := len(data) / count
+		for k := 0; k < count; k++ {
+			w.frames = append(w.frames, data[k*size:(k+1)*size])
+		}
+		return nil
+	default: // ebml lacing
+		return w.readEBMLLacing(data)
+	}
+}
+
+func (w *webmReader) readXiphLacing(data []byte) error {
+	if len(data) < 1 {
+		return errWebMInvalid
+	}
+
+	count := int(data[0]) + 1
+	data = data[1:]
+
+	sizes := make([]int, count-1)
+	for k := range sizes {
+		// Each size is the sum of bytes, up until a byte that isn't 255
+		for {
+			if len(data) == 0 {
+				return errWebMInvalid
+			}
+
+			b := data[0]
+			sizes[k] += int(b)
+			data = data[1:]
+			if b != 255 {
+				break
+			}
+		}
+	}
+
+	return w.splitLacing(data, sizes)
+}
+
+func (w *webmReader) readEBMLLacing(data []byte) error {
+	if len(data) < 1 {
+		return errWebMInvalid
+	}
+
+	count := int(data[0]) + 1
+	data = data[1:]
+
+	sizes := make([]int, count-1)
+	for k := range sizes {
+		v, n := readVint(data, false)
+		if n == 0 {
+			return errWebMInvalid
+		}
+
+		if k == 0 {
+			sizes[k] = int(v)
+		} else {
+			// The other sizes are stored as the signed difference from the previous size
+			diff := int64(v) - (int64(1)<<(7*uint(n)-1) - 1)
+			sizes[k] = sizes[k-1] + int(diff)
+		}
+
+		if sizes[k] < 0 {
+			return errWebMInvalid
+		}
+
+		data = data[n:]
+	}
+
+	return w.splitLacing(data, sizes)
+}
+
+// splitLacing splits data into frames of sizes, the last frame is whatever is left.
+func (w *webmReader) splitLacing(data []byte, sizes []int) error {
+	for _, size := range sizes {
+		if size > len(data) {
+			return errWebMInvalid
+		}
+
+		w.frames = append(w.frames, data[:size])
+		data = data[size:]
+	}
+
+	w.frames = append(w.frames, data)
+	return nil
+}
+
+// readElement reads the id and the size of the next element. The size is webmUnknownSize
+// for master elements that are being streamed. It returns io.EOF only if the stream ends before the element.
+func (w *webmReader) readElement() (uint64, int64, error) {
+	id, err := w.readStreamVint(true)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	first, err := w.r.Peek(1)
+	if err == io.EOF {
+		return 0, 0, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return 0, 0, err
+	}
+
+	width := vintWidth(first[0])
+	size, err := w.readStreamVint(false)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, 0, err
+	}
+
+	// A size with all of its bits set means that the size is unknown
+	if width > 0 && size == uint64(1)<<(7*uint(width))-1 {
+		return id, webmUnknownSize, nil
+	}
+
+	return id, int64(size), nil
+}
+
+// readData reads the data of an element that has a size.
+func (w *webmReader) readData(size int64) ([]byte, error) {
+	// Only blocks and small values are read into memory, a frame is never this big
+	if size < 0 || size > webmMaxDataSize {
+		return nil, errWebMInvalid
+	}
+
+	data := make([]byte, size)
+	_, err := io.ReadFull(w.r, data)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return data, err
+}
+
+// readStreamVint reads a variable length integer from the stream. Element ids keep the length marker.
+// It returns io.EOF if the stream is over before the integer, and io.ErrUnexpectedEOF if it's cut off.
+func (w *webmReader) readStreamVint(marker bool) (uint64, error) {
+	first, err := w.r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+
+	width := vintWidth(first[0])
+	if width == 0 {
+		return 0, errWebMInvalid
+	}
+
+	data := make([]byte, width)
+	_, err = io.ReadFull(w.r, data)
+	if err == io.EOF {
+		// Peek found the first byte, so the integer has been cut off
+		err = io.ErrUnexpectedEOF
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	v, _ := readVint(data, marker)
+	return v, nil
+}
+
+// vintWidth returns the length of a variable length integer from its first byte, 0 if it's invalid.
+func vintWidth(first byte) int {
+	for k := 0; k < 8; k++ {
+		if first&(0x80>>uint(k)) != 0 {
+			return k + 1
+		}
+	}
+
+	return 0
+}
+
+// readVint reads a variable length integer from data, and returns it with its length.
+// The length is 0 if data doesn't hold a valid integer.
+func readVint(data []byte, marker bool) (uint64, int) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+
+	width := vintWidth(data[0])
+	if width == 0 || len(data) < width {
+		return 0, 0
+	}
+
+	v := uint64(data[0])
+	if !marker {
+		v &= uint64(0xFF >> uint(width))
+	}
+
+	for k := 1; k < width; k++ {
+		v = v<<8 | uint64(data[k])
+	}
+
+	return v, width
+}
+
+// readUint reads a big endian unsigned integer of any length.
+func readUint(data []byte) uint64 {
+	v := uint64(0)
+	for _, b := range data {
+		v = v<<8 | uint64(b)
+	}
+
+	return v
+}
+
+// trimNull removes the null bytes that strings might be padded with.
+func trimNull(data []byte) []byte {
+	for len(data) > 0 && data[len(data)-1] == 0 {
+		data = data[:len(data)-1]
+	}
+
+	return data
+}
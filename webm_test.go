@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// ebmlelement returns an element with the id written as its bytes, the data has to be shorter than 127 bytes.
+func ebmlelement(id []byte, data ...[]byte) []byte {
+	body := bytes.Join(data, nil)
+	return append(append(append([]byte{}, id...), 0x80|byte(len(body))), body...)
+}
+
+// testwebm returns a WebM file with an opus track and a cluster that holds frames, one per simple block.
+func testwebm(frames ...[]byte) []byte {
+	header := ebmlelement([]byte{0x1A, 0x45, 0xDF, 0xA3}, ebmlelement([]byte{0x42, 0x82}, []byte("webm")))
+	tracks := ebmlelement([]byte{0x16, 0x54, 0xAE, 0x6B}, ebmlelement([]byte{0xAE},
+		ebmlelement([]byte{0xD7}, []byte{1}),
+		ebmlelement([]byte{0x86}, []byte(webmOpusCodec))))
+
+	var blocks [][]byte
+	for _, frame := range frames {
+		// The track number, the timecode and the flags without lacing
+		blocks = append(blocks, ebmlelement([]byte{0xA3}, []byte{0x81, 0, 0, 0x80}, frame))
+	}
+
+	cluster := ebmlelement([]byte{0x1F, 0x43, 0xB6, 0x75}, blocks...)
+
+	// The segment is streamed, so its size is unknown
+	segment := append([]byte{0x18, 0x53, 0x80, 0x67, 0xFF}, append(tracks, cluster...)...)
+	return append(header, segment...)
+}
+
+func TestWebMReader(t *testing.T) {
+	frames := [][]byte{{0xfc, 0x01}, {0xfc, 0x02}}
+	file := testwebm(frames...)
+
+	tests := []struct {
+		name string
+		data []byte
+		// want is how many frames are read before err
+		want int
+		err  error
+	}{
+		{name: "whole file", data: file, want: 2, err: io.EOF},
+		{name: "cut off in a block", data: file[:len(file)-1], want: 1, err: io.ErrUnexpectedEOF},
+		{name: "cut off after the id of a block", data: file[:len(file)-7], want: 1, err: io.ErrUnexpectedEOF},
+		{name: "cut off after a block", data: file[:len(file)-8], want: 1, err: io.EOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := newWebMReader(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			read := 0
+			for {
+				var frame []byte
+				frame, err = w.ReadFrame()
+				if err != nil {
+					break
+				}
+
+				if !bytes.Equal(frame, frames[read]) {
+					t.Errorf("frame %d is %x, want %x", read, frame, frames[read])
+				}
+				read++
+			}
+
+			if read != tt.want || err != tt.err {
+				t.Errorf("read %d frames then %v, want %d then %v", read, err, tt.want, tt.err)
+			}
+		})
+	}
+}